@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+const originatingIdentityKey logContextKey = "originating-identity"
+
+// auditEvent is one line of the audit trail
+type auditEvent struct {
+	Time           time.Time `json:"time"`
+	Operation      string    `json:"operation"`
+	InstanceID     string    `json:"instance_id"`
+	BindingID      string    `json:"binding_id,omitempty"`
+	PlanID         string    `json:"plan_id,omitempty"`
+	Platform       string    `json:"platform,omitempty"`
+	User           string    `json:"user,omitempty"`
+	Organization   string    `json:"organization,omitempty"`
+	Space          string    `json:"space,omitempty"`
+	RequestID      string    `json:"request_identity,omitempty"`
+	BrokerUser     string    `json:"broker_user,omitempty"`
+	Objects        []string  `json:"ontap_objects,omitempty"`
+	JobUUIDs       []string  `json:"job_uuids,omitempty"`
+	Outcome        string    `json:"outcome"`
+	Error          string    `json:"error,omitempty"`
+	CorrelationID  string    `json:"correlation_id,omitempty"`
+	OperationState string    `json:"operation_state,omitempty"`
+}
+
+// brokerContext is the part of the osb context object the audit trail cares about
+type brokerContext struct {
+	Platform         string `json:"platform"`
+	OrganizationGUID string `json:"organization_guid"`
+	OrganizationName string `json:"organization_name"`
+	SpaceGUID        string `json:"space_guid"`
+	SpaceName        string `json:"space_name"`
+}
+
+type auditSink interface {
+	write(event auditEvent) error
+}
+
+// auditLog writes the events of broker operations to the sink. A nil auditLog records nothing.
+type auditLog struct {
+	sink   auditSink
+	logger lager.Logger
+}
+
+// newAuditLog creates the audit log for destination, which is one of
+//   - "" to disable auditing
+//   - stdout, or a file path, for JSON lines appended to the file
+//   - syslog://host:port, syslog+tcp://host:port or syslog:// (local) for CEF messages
+func newAuditLog(destination string, logger lager.Logger) (*auditLog, error) {
+	if destination == "" {
+		return nil, nil
+	}
+
+	var sink auditSink
+	switch {
+	case destination == "stdout":
+		sink = &jsonLinesSink{w: os.Stdout}
+	case strings.HasPrefix(destination, "syslog"):
+		s, err := newSyslogSink(destination)
+		if err != nil {
+			return nil, err
+		}
+		sink = s
+	default:
+		f, err := os.OpenFile(destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open audit log: %s", err)
+		}
+		sink = &jsonLinesSink{w: f}
+	}
+
+	return &auditLog{sink: sink, logger: logger.Session("audit")}, nil
+}
+
+// auditRecord collects what an operation did until it is written by finish
+type auditRecord struct {
+	log   *auditLog
+	mu    sync.Mutex
+	event auditEvent
+}
+
+type auditRecordKey struct{}
+
+// start begins the audit record of an operation and attaches it to the context so the ontap objects touched can be added to it
+func (a *auditLog) start(ctx context.Context, operation string, event auditEvent) (context.Context, *auditRecord) {
+	if a == nil {
+		return ctx, nil
+	}
+
+	event.Operation = operation
+	event.Platform, event.User = originatingUser(ctx)
+	event.RequestID = requestIdentity(ctx)
+	event.BrokerUser = brokerUserName(ctx)
+	event.CorrelationID = correlationID(ctx)
+
+	rec := &auditRecord{log: a, event: event}
+	return context.WithValue(ctx, auditRecordKey{}, rec), rec
+}
+
+// withContext adds the organization and space of the osb context object, when the platform sent one
+func (r *auditRecord) withContext(raw json.RawMessage) *auditRecord {
+	if r == nil || len(raw) == 0 {
+		return r
+	}
+
+	var c brokerContext
+	if json.Unmarshal(raw, &c) != nil {
+		return r
+	}
+
+	if c.Platform != "" {
+		r.event.Platform = c.Platform
+	}
+	r.event.Organization = nameOrGUID(c.OrganizationName, c.OrganizationGUID, r.event.Organization)
+	r.event.Space = nameOrGUID(c.SpaceName, c.SpaceGUID, r.event.Space)
+
+	return r
+}
+
+func nameOrGUID(name, guid, fallback string) string {
+	switch {
+	case name != "" && guid != "":
+		return name + " (" + guid + ")"
+	case guid != "":
+		return guid
+	}
+
+	return fallback
+}
+
+// auditObject records an ontap object the operation in ctx created, changed or deleted, e.g. auditObject(ctx, "volume", name)
+func auditObject(ctx context.Context, kind, name string) {
+	if rec, ok := ctx.Value(auditRecordKey{}).(*auditRecord); ok {
+		rec.mu.Lock()
+		rec.event.Objects = append(rec.event.Objects, kind+":"+name)
+		rec.mu.Unlock()
+	}
+}
+
+// auditJob records an ontap job started by the operation in ctx
+func auditJob(ctx context.Context, jobID string) {
+	if rec, ok := ctx.Value(auditRecordKey{}).(*auditRecord); ok && jobID != "" {
+		rec.mu.Lock()
+		rec.event.JobUUIDs = append(rec.event.JobUUIDs, jobID)
+		rec.mu.Unlock()
+	}
+}
+
+// finish writes the record with the outcome of the operation. Defer it after mapFailure, like logOutcome.
+func (r *auditRecord) finish(err *error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.event.Time = time.Now().UTC()
+	if *err != nil {
+		r.event.Error = (*err).Error()
+	}
+
+	r.event.Outcome = "success"
+	if r.event.Error != "" {
+		r.event.Outcome = "failure"
+	}
+
+	if werr := r.log.sink.write(r.event); werr != nil {
+		r.log.logger.Error("write-failed", werr, lager.Data{"operation": r.event.Operation, "instance-id": r.event.InstanceID})
+	}
+}
+
+// finishPoll writes the record of a last_operation poll once the operation is done, or when the poll changed ontap objects
+func (r *auditRecord) finishPoll(op *domain.LastOperation, err *error) {
+	if r == nil || (op.State == domain.InProgress && len(r.event.Objects) == 0 && *err == nil) {
+		return
+	}
+
+	r.event.OperationState = string(op.State)
+	if op.State == domain.Failed && *err == nil {
+		r.event.Error = op.Description
+	}
+	r.finish(err)
+}
+
+// withOriginatingIdentity puts the X-Broker-API-Originating-Identity header in the request context
+func withOriginatingIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := r.Header.Get("X-Broker-API-Originating-Identity")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), originatingIdentityKey, identity)))
+	})
+}
+
+// originatingUser decodes the originating identity header: the platform followed by base64 encoded json.
+// Cloud Foundry sends {"user_id": "..."}, Kubernetes {"username": "..."}.
+func originatingUser(ctx context.Context) (string, string) {
+	header, _ := ctx.Value(originatingIdentityKey).(string)
+	platform, value, found := strings.Cut(header, " ")
+	if !found {
+		return platform, ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return platform, ""
+	}
+
+	var identity struct {
+		UserID   string `json:"user_id"`
+		Username string `json:"username"`
+	}
+	if json.Unmarshal(decoded, &identity) != nil {
+		return platform, ""
+	}
+
+	if identity.UserID != "" {
+		return platform, identity.UserID
+	}
+
+	return platform, identity.Username
+}
+
+type jsonLinesSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *jsonLinesSink) write(event auditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(destination string) (*syslogSink, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid audit log destination %s: %s", destination, err)
+	}
+
+	var network string
+	switch u.Scheme {
+	case "syslog":
+		if u.Host != "" {
+			network = "udp"
+		}
+	case "syslog+udp":
+		network = "udp"
+	case "syslog+tcp":
+		network = "tcp"
+	default:
+		return nil, fmt.Errorf("Invalid audit log destination %s. Allowed schemes: syslog, syslog+udp, syslog+tcp", destination)
+	}
+
+	w, err := syslog.Dial(network, u.Host, syslog.LOG_INFO|syslog.LOG_AUTH, "cf-ontapsmb-broker")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to syslog: %s", err)
+	}
+
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) write(event auditEvent) error {
+	return s.w.Info(event.cef())
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// cef formats the event as an ArcSight Common Event Format message
+func (e auditEvent) cef() string {
+	severity := 3
+	if e.Outcome == "failure" {
+		severity = 7
+	}
+
+	fields := [][2]string{
+		{"rt", fmt.Sprint(e.Time.UnixMilli())},
+		{"act", e.Operation},
+		{"outcome", e.Outcome},
+		{"suser", e.User},
+		{"duser", e.BrokerUser},
+		{"cs1Label", "instance_id"}, {"cs1", e.InstanceID},
+		{"cs2Label", "binding_id"}, {"cs2", e.BindingID},
+		{"cs3Label", "organization"}, {"cs3", e.Organization},
+		{"cs4Label", "space"}, {"cs4", e.Space},
+		{"cs5Label", "ontap_objects"}, {"cs5", strings.Join(e.Objects, ",")},
+		{"cs6Label", "job_uuids"}, {"cs6", strings.Join(e.JobUUIDs, ",")},
+		{"externalId", e.RequestID},
+	}
+	if e.Error != "" {
+		fields = append(fields, [2]string{"reason", e.Error})
+	}
+
+	ext := make([]string, 0, len(fields))
+	for _, f := range fields {
+		ext = append(ext, f[0]+"="+cefValueEscaper.Replace(f[1]))
+	}
+
+	return fmt.Sprintf("CEF:0|orangeglasses|cf-ontapsmb-broker|1.0|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(e.Operation),
+		cefHeaderEscaper.Replace(e.Operation+" "+e.Outcome),
+		severity,
+		strings.Join(ext, " "))
+}
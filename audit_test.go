@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCEFEscaping(t *testing.T) {
+	event := auditEvent{
+		Time:       time.UnixMilli(1700000000000),
+		Operation:  "bind|unbind",
+		InstanceID: `inst\1`,
+		User:       "user=admin",
+		Outcome:    "failure",
+		Error:      "line one\nline two\r",
+		Objects:    []string{"volume", "cifs-share"},
+	}
+
+	cef := event.cef()
+
+	for _, expected := range []string{
+		`CEF:0|orangeglasses|cf-ontapsmb-broker|1.0|bind\|unbind|bind\|unbind failure|7|`,
+		`rt=1700000000000 `,
+		`suser=user\=admin `,
+		`cs1=inst\\1 `,
+		`cs5=volume,cifs-share `,
+		`reason=line one\nline two\r`,
+	} {
+		if !strings.Contains(cef, expected) {
+			t.Errorf("expected %q in %q", expected, cef)
+		}
+	}
+
+	if strings.ContainsAny(cef, "\n\r") {
+		t.Errorf("message contains a raw line break: %q", cef)
+	}
+}
+
+func TestCEFSeverity(t *testing.T) {
+	if cef := (auditEvent{Operation: "provision", Outcome: "success"}).cef(); !strings.Contains(cef, "|provision success|3|") {
+		t.Errorf("expected severity 3 for success, got %q", cef)
+	}
+}
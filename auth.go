@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi/v7"
+	"github.com/pivotal-cf/brokerapi/v7/middlewares"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	roleBroker   = "broker"   //the OSB api, used by cloud controller
+	roleOperator = "operator" //the /operator endpoints
+)
+
+const brokerUserKey logContextKey = "broker-user"
+
+// brokerUser is a set of credentials for the broker api. Password is either plain text or a bcrypt hash.
+// Instead of a password a user can authenticate with a client certificate with ClientCertCN as common name.
+type brokerUser struct {
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	ClientCertCN string   `json:"client_cert_cn"`
+	Roles        []string `json:"roles"`
+}
+
+func (u brokerUser) hasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseBrokerUsers reads the BROKER_USERS json list. BROKER_USERNAME and BROKER_PASSWORD are added as a user with all roles.
+func parseBrokerUsers(usersJSON, username, password string) ([]brokerUser, error) {
+	var users []brokerUser
+	if usersJSON != "" {
+		if err := json.Unmarshal([]byte(usersJSON), &users); err != nil {
+			return nil, fmt.Errorf("Unable to parse BROKER_USERS: %s", err)
+		}
+	}
+
+	if username != "" {
+		users = append(users, brokerUser{Username: username, Password: password, Roles: []string{roleBroker, roleOperator}})
+	}
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("No broker users configured. Set BROKER_USERS or BROKER_USERNAME and BROKER_PASSWORD")
+	}
+
+	seen := make(map[string]bool)
+	for _, u := range users {
+		if u.Username == "" && u.ClientCertCN == "" {
+			return nil, fmt.Errorf("Broker users need a username or a client_cert_cn")
+		}
+
+		if u.Username != "" && u.Password == "" {
+			return nil, fmt.Errorf("Broker user %s has no password", u.Username)
+		}
+
+		if isBcrypt(u.Password) {
+			if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+				return nil, fmt.Errorf("Invalid bcrypt hash for broker user %s: %s", u.Username, err)
+			}
+		}
+
+		for _, role := range u.Roles {
+			if role != roleBroker && role != roleOperator {
+				return nil, fmt.Errorf("Broker user %s has unknown role %q. Allowed roles: %s, %s", u.Username, role, roleBroker, roleOperator)
+			}
+		}
+
+		if u.Username != "" && seen[u.Username] {
+			return nil, fmt.Errorf("Broker user %s is configured more than once", u.Username)
+		}
+		seen[u.Username] = true
+	}
+
+	return users, nil
+}
+
+func isBcrypt(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// brokerAuth authenticates requests with basic auth or a client certificate. The users can be replaced while the broker is running.
+// On CF the router terminates TLS, so the client certificate can only be taken from the X-Forwarded-Client-Cert header the router sets.
+type brokerAuth struct {
+	users atomic.Pointer[[]brokerUser]
+
+	//forwardedCertCAs verifies client certificates from X-Forwarded-Client-Cert. nil when the header is not trusted
+	forwardedCertCAs *x509.CertPool
+
+	//bcrypt is slow on purpose and cloud controller polls a lot, so verified hash/password combinations are remembered
+	verified sync.Map
+}
+
+func newBrokerAuth(users []brokerUser, forwardedCertCAs *x509.CertPool) *brokerAuth {
+	a := &brokerAuth{forwardedCertCAs: forwardedCertCAs}
+	a.set(users)
+	return a
+}
+
+func (a *brokerAuth) set(users []brokerUser) {
+	a.users.Store(&users)
+}
+
+func (a *brokerAuth) passwordMatches(stored, given string) bool {
+	if !isBcrypt(stored) {
+		s := sha256.Sum256([]byte(stored))
+		g := sha256.Sum256([]byte(given))
+		return subtle.ConstantTimeCompare(s[:], g[:]) == 1
+	}
+
+	key := sha256.Sum256([]byte(stored + "\x00" + given))
+	if _, ok := a.verified.Load(key); ok {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(given)) != nil {
+		return false
+	}
+
+	a.verified.Store(key, struct{}{})
+	return true
+}
+
+// clientCertCN returns the common name of the verified client certificate of the request, from the tls connection or the forwarded header
+func (a *brokerAuth) clientCertCN(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	if a.forwardedCertCAs == nil {
+		return ""
+	}
+
+	cert, err := forwardedClientCert(r.Header.Get(xfccHeader))
+	if err != nil || cert == nil {
+		return ""
+	}
+
+	if _, err = cert.Verify(x509.VerifyOptions{Roots: a.forwardedCertCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		return ""
+	}
+
+	return cert.Subject.CommonName
+}
+
+const xfccHeader = "X-Forwarded-Client-Cert"
+
+// forwardedClientCert parses the header as gorouter sets it (base64 DER) or in the envoy format (Cert="<url encoded PEM>";...)
+func forwardedClientCert(header string) (*x509.Certificate, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	//with several proxies the last element was added by the one closest to the broker
+	elements := strings.Split(header, ",")
+	element := strings.TrimSpace(elements[len(elements)-1])
+
+	if !strings.ContainsAny(element, `;"`) && !strings.HasPrefix(element, "Cert=") {
+		der, err := base64.StdEncoding.DecodeString(element)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s header: %s", xfccHeader, err)
+		}
+		return x509.ParseCertificate(der)
+	}
+
+	for _, pair := range strings.Split(element, ";") {
+		key, value, _ := strings.Cut(pair, "=")
+		if !strings.EqualFold(strings.TrimSpace(key), "Cert") {
+			continue
+		}
+
+		decoded, err := url.QueryUnescape(strings.Trim(value, `"`))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s header: %s", xfccHeader, err)
+		}
+
+		block, _ := pem.Decode([]byte(decoded))
+		if block == nil {
+			return nil, fmt.Errorf("Invalid %s header: no PEM certificate", xfccHeader)
+		}
+		return x509.ParseCertificate(block.Bytes)
+	}
+
+	return nil, nil
+}
+
+func (a *brokerAuth) authenticate(r *http.Request) (brokerUser, bool) {
+	users := *a.users.Load()
+
+	if cn := a.clientCertCN(r); cn != "" {
+		for _, u := range users {
+			if u.ClientCertCN != "" && u.ClientCertCN == cn {
+				return u, true
+			}
+		}
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return brokerUser{}, false
+	}
+
+	for _, u := range users {
+		if u.Username != "" && subtle.ConstantTimeCompare([]byte(u.Username), []byte(username)) == 1 && a.passwordMatches(u.Password, password) {
+			return u, true
+		}
+	}
+
+	return brokerUser{}, false
+}
+
+// require only lets requests through from users with the role
+func (a *brokerAuth) require(role string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := a.authenticate(r)
+			if !ok {
+				http.Error(w, "Not Authorized", http.StatusUnauthorized)
+				return
+			}
+
+			if !user.hasRole(role) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			name := user.Username
+			if name == "" {
+				name = "cn=" + user.ClientCertCN
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), brokerUserKey, name)))
+		})
+	}
+}
+
+// brokerUserName returns the broker user that made the request
+func brokerUserName(ctx context.Context) string {
+	name, _ := ctx.Value(brokerUserKey).(string)
+	return name
+}
+
+// serverTLSConfig returns nil when the broker serves plain http. With a client CA, client certificates are verified when the client sends one.
+func serverTLSConfig(cert, key, clientCA string) (*tls.Config, error) {
+	if cert == "" {
+		return nil, nil
+	}
+
+	certPEM, err := readPEM(cert)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading TLS certificate: %s", err)
+	}
+
+	keyPEM, err := readPEM(key)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading TLS key: %s", err)
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading TLS certificate: %s", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCA != "" {
+		pool, err := clientCAPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+func clientCAPool(clientCA string) (*x509.CertPool, error) {
+	data, err := readPEM(clientCA)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading TLS client CA: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No valid certificates found in TLS client CA")
+	}
+
+	return pool, nil
+}
+
+// newBrokerHandler does what brokerapi.New does, but with our own authentication middleware
+func newBrokerHandler(serviceBroker brokerapi.ServiceBroker, logger lager.Logger, authMiddleware mux.MiddlewareFunc) http.Handler {
+	router := mux.NewRouter()
+	brokerapi.AttachRoutes(router, serviceBroker, logger)
+
+	apiVersionMiddleware := middlewares.APIVersionMiddleware{LoggerFactory: logger}
+
+	router.Use(middlewares.AddCorrelationIDToContext)
+	router.Use(authMiddleware)
+	router.Use(middlewares.AddOriginatingIdentityToContext)
+	router.Use(apiVersionMiddleware.ValidateAPIVersionHdr)
+	router.Use(middlewares.AddInfoLocationToContext)
+
+	return router
+}
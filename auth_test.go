@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return testCA{cert: cert, key: key}
+}
+
+func (ca testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// clientCert returns the DER encoded client certificate for cn
+func (ca testCA) clientCert(t *testing.T, cn string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func TestForwardedClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	users := []brokerUser{{ClientCertCN: "cloud-controller", Roles: []string{roleBroker}}}
+
+	der := ca.clientCert(t, "cloud-controller")
+	envoy := `Hash=abc;Cert="` + url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))) + `";Subject="CN=cloud-controller"`
+
+	for _, tc := range []struct {
+		name   string
+		cas    *x509.CertPool
+		header string
+		ok     bool
+	}{
+		{"gorouter", ca.pool(), base64.StdEncoding.EncodeToString(der), true},
+		{"envoy", ca.pool(), envoy, true},
+		{"untrusted header", nil, base64.StdEncoding.EncodeToString(der), false},
+		{"other ca", ca.pool(), base64.StdEncoding.EncodeToString(other.clientCert(t, "cloud-controller")), false},
+		{"unknown cn", ca.pool(), base64.StdEncoding.EncodeToString(ca.clientCert(t, "someone")), false},
+		{"garbage", ca.pool(), "not a certificate", false},
+	} {
+		auth := newBrokerAuth(users, tc.cas)
+
+		r := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+		r.Header.Set(xfccHeader, tc.header)
+
+		if _, ok := auth.authenticate(r); ok != tc.ok {
+			t.Errorf("%s: expected authenticated=%t", tc.name, tc.ok)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	auth := newBrokerAuth([]brokerUser{
+		{Username: "cc", Password: "secret", Roles: []string{roleBroker}},
+		{Username: "ops", Password: "secret", Roles: []string{roleOperator}},
+	}, nil)
+
+	handler := auth.require(roleOperator)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for user, status := range map[string]int{"ops": http.StatusOK, "cc": http.StatusForbidden, "": http.StatusUnauthorized} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if user != "" {
+			r.SetBasicAuth(user, "secret")
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("%q: expected %d, got %d", user, status, w.Code)
+		}
+	}
+}
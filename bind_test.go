@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+// fakeCredentialStore records what the broker stores and deletes
+type fakeCredentialStore struct {
+	values  map[string]interface{}
+	readers map[string][]string
+	deleted []string
+}
+
+func (f *fakeCredentialStore) Put(_ context.Context, name string, value interface{}, readers []string) error {
+	f.values[name] = value
+	f.readers[name] = readers
+	return nil
+}
+
+func (f *fakeCredentialStore) Delete(_ context.Context, name string) error {
+	f.deleted = append(f.deleted, name)
+	delete(f.values, name)
+	return nil
+}
+
+const (
+	testInstanceID = "6a3c0e1b-5d2f-4f3e-9a55-1f6b2c8d9e01"
+	testBindingID  = "binding-1"
+)
+
+// newBindTestBroker returns a broker whose cluster accepts share acls over the api and runs cli commands on a fake runner
+func newBindTestBroker(t *testing.T, store CredentialStore) (*broker, *fakeRunner) {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/protocols/cifs/shares/svm-uuid/"+generateVolumeName("A", testInstanceID)+"/acls") {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL + "/api")
+	runner := &fakeRunner{results: map[string]SSHResult{
+		"vserver cifs users-and-groups local-user show -fields user-name -full-name " + testBindingID: {Stdout: "svm1 user1\n"},
+	}}
+	client := &OntapClient{URL: *u, httpClient: *server.Client(), cli: runner, commandTimeout: time.Minute}
+	client.capabilities.caps.SvmUUIDs = map[string]string{"svm1": "svm-uuid"}
+
+	return &broker{
+		env: brokerConfig{
+			VolumeNamePrefix:  "A",
+			OntapSvmName:      "svm1",
+			CifsHostname:      "cifs1.example.com",
+			CredhubPathPrefix: "/c/cf-ontapsmb-broker",
+		},
+		ontapClient: client,
+		logger:      lager.NewLogger("test"),
+		credentials: store,
+	}, runner
+}
+
+func TestBindStoresCredentialsInCredhub(t *testing.T) {
+	store := &fakeCredentialStore{values: map[string]interface{}{}, readers: map[string][]string{}}
+	b, _ := newBindTestBroker(t, store)
+
+	binding, err := b.Bind(context.Background(), testInstanceID, testBindingID, domain.BindDetails{
+		AppGUID:   "app-guid",
+		PlanID:    "plan-id",
+		ServiceID: "service-id",
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "/c/cf-ontapsmb-broker/service-id/" + testBindingID + "/credentials"
+	if !reflect.DeepEqual(binding.Credentials, map[string]string{"credhub-ref": name}) {
+		t.Errorf("expected a credhub-ref to %s, got %v", name, binding.Credentials)
+	}
+
+	if !reflect.DeepEqual(store.readers[name], []string{"mtls-app:app-guid"}) {
+		t.Errorf("expected the app to be a reader, got %v", store.readers[name])
+	}
+
+	stored, ok := store.values[name].(map[string]string)
+	if !ok {
+		t.Fatalf("expected stored credentials, got %v", store.values[name])
+	}
+
+	mountConfig := binding.VolumeMounts[0].Device.MountConfig
+	if stored["username"] == "" || stored["username"] != mountConfig["username"] || stored["password"] != mountConfig["password"] {
+		t.Errorf("stored credentials %v don't match the mount config %v", stored, mountConfig)
+	}
+
+	if source := "//cifs1.example.com/" + generateVolumeName("A", testInstanceID); stored["source"] != source || mountConfig["source"] != source {
+		t.Errorf("expected source %s, got %v and %v", source, stored["source"], mountConfig["source"])
+	}
+}
+
+func TestBindWithoutCredhub(t *testing.T) {
+	b, _ := newBindTestBroker(t, nil)
+
+	binding, err := b.Bind(context.Background(), testInstanceID, testBindingID, domain.BindDetails{PlanID: "plan-id"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(binding.Credentials, struct{}{}) {
+		t.Errorf("expected empty credentials, got %v", binding.Credentials)
+	}
+}
+
+func TestUnbindDeletesCredentials(t *testing.T) {
+	store := &fakeCredentialStore{values: map[string]interface{}{}, readers: map[string][]string{}}
+	b, runner := newBindTestBroker(t, store)
+
+	_, err := b.Unbind(context.Background(), testInstanceID, testBindingID, domain.UnbindDetails{PlanID: "plan-id", ServiceID: "service-id"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"/c/cf-ontapsmb-broker/service-id/" + testBindingID + "/credentials"}; !reflect.DeepEqual(store.deleted, expected) {
+		t.Errorf("expected %v to be deleted, got %v", expected, store.deleted)
+	}
+
+	if last := runner.commands[len(runner.commands)-1].Cmd; last != "vserver cifs users-and-groups local-user delete -user-name user1" {
+		t.Errorf("expected the cifs user to be deleted, got %q", last)
+	}
+}
+
+func TestUnbindDeletesUsersOnBothSites(t *testing.T) {
+	b, runner := newBindTestBroker(t, nil)
+	b.catalog = brokerCatalog{plans: map[string]planSettings{"plan-id": {Replicated: true}}}
+
+	drRunner := &fakeRunner{results: map[string]SSHResult{
+		"vserver cifs users-and-groups local-user show -fields user-name -full-name " + testBindingID: {Stdout: "svm2 user2\n"},
+	}}
+	b.dr = &site{client: &OntapClient{cli: drRunner, commandTimeout: time.Minute}, svmName: "svm2", cifsHostname: "cifs2.example.com"}
+
+	_, err := b.Unbind(context.Background(), testInstanceID, testBindingID, domain.UnbindDetails{PlanID: "plan-id"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for user, r := range map[string]*fakeRunner{"user1": runner, "user2": drRunner} {
+		if last := r.commands[len(r.commands)-1].Cmd; last != "vserver cifs users-and-groups local-user delete -user-name "+user {
+			t.Errorf("expected %s to be deleted, got %q", user, last)
+		}
+	}
+}
+
+func TestFailoverRemovesSourceUsers(t *testing.T) {
+	volumeName := generateVolumeName("A", testInstanceID)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, "/protocols/cifs/shares/svm-uuid/"+volumeName+"/acls") {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"records": [
+			{"user_or_group": "BUILTIN\\Guests", "type": "windows", "permission": "no_access"},
+			{"user_or_group": "Everyone", "type": "windows", "permission": "full_control"},
+			{"user_or_group": "SVM1\\user1", "type": "windows", "permission": "full_control"}
+		]}`))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/api")
+	runner := &fakeRunner{}
+	client := &OntapClient{URL: *u, httpClient: *server.Client(), cli: runner, commandTimeout: time.Minute}
+	client.capabilities.caps.SvmUUIDs = map[string]string{"svm1": "svm-uuid"}
+	b := &broker{env: brokerConfig{OntapSvmName: "svm1"}, ontapClient: client}
+
+	b.removeSourceUsers(context.Background(), volumeName)
+
+	if len(runner.commands) != 1 || runner.commands[0].Cmd != "vserver cifs users-and-groups local-user delete -user-name user1" {
+		t.Errorf("expected only user1 to be deleted, got %v", runner.commands)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
+	"net/http"
+	"time"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/pivotal-cf/brokerapi/v7"
 	"github.com/pivotal-cf/brokerapi/v7/domain"
 	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
@@ -15,20 +18,199 @@ import (
 )
 
 type broker struct {
-	services    []brokerapi.Service
+	catalog     brokerCatalog
 	env         brokerConfig
 	ontapClient *OntapClient
+	dr          *site
+	logger      lager.Logger
+	audit       *auditLog
+	credentials CredentialStore
+	steps       stepJobs
+}
+
+type AutosizeParameters struct {
+	Mode          string `json:"mode"`
+	Maximum       string `json:"maximum"`
+	GrowThreshold *int   `json:"grow_threshold"`
+}
+
+type QosParameters struct {
+	MaxIOPS int64 `json:"max_iops"`
+	MaxMBPS int64 `json:"max_mbps"`
 }
 
 type ProvisionParameters struct {
-	Size string `json:"size"`
+	Size     string              `json:"size"`
+	Autosize *AutosizeParameters `json:"autosize"`
+	Qos      *QosParameters      `json:"qos"`
+}
+
+type UpdateParameters struct {
+	Autosize *AutosizeParameters `json:"autosize"`
+}
+
+type BindParameters struct {
+	Mount string `json:"mount"`
+}
+
+// volumeAutosize validates the autosize parameters and converts them to what ontap expects. The maximum defaults to the maximum volume size of the plan.
+func (b *broker) volumeAutosize(planID string, params AutosizeParameters, volumeSize int64) (VolumeAutosize, error) {
+	switch params.Mode {
+	case "grow", "grow_shrink":
+	case "off":
+		return VolumeAutosize{Mode: "off"}, nil
+	default:
+		return VolumeAutosize{}, fmt.Errorf("Invalid autosize mode %q. Allowed modes: grow, grow_shrink, off", params.Mode)
+	}
+
+	planMaximum := b.maxVolumeSize(planID)
+	maximum := planMaximum
+	if params.Maximum != "" {
+		size, err := stdsize.Parse(params.Maximum)
+		if err != nil {
+			return VolumeAutosize{}, fmt.Errorf("Unable to parse autosize maximum %s", params.Maximum)
+		}
+		maximum = int64(size)
+	}
+
+	if maximum > planMaximum {
+		return VolumeAutosize{}, fmt.Errorf("Requested autosize maximum exceeds the maximum volume size. You requested %s, Max is %v", params.Maximum, stdsize.Value(planMaximum))
+	}
+
+	if maximum < volumeSize {
+		return VolumeAutosize{}, fmt.Errorf("Autosize maximum %v is smaller than the volume size %v", stdsize.Value(maximum), stdsize.Value(volumeSize))
+	}
+
+	autosize := VolumeAutosize{Mode: params.Mode, Maximum: maximum}
+	//without a threshold ontap keeps its default
+	if t := params.GrowThreshold; t != nil {
+		if *t < 1 || *t > 99 {
+			return VolumeAutosize{}, fmt.Errorf("Autosize grow_threshold must be between 1 and 99 percent")
+		}
+		autosize.GrowThreshold = *t
+	}
+
+	return autosize, nil
+}
+
+// applyAutosize sets autosize on the instance's volume unless it already matches. Returns true once the volume is configured as requested
+// or the job that configures it succeeded.
+func (b *broker) applyAutosize(ctx context.Context, operation, instanceID string, autosize VolumeAutosize) (bool, error) {
+	if done, ok, err := b.steps.status(ctx, operation, "autosize"); ok {
+		return done, err
+	}
+
+	name := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	id, err := b.ontapClient.GetVolumeIDByName(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	vol, err := b.ontapClient.GetVolumeByID(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	if current := vol.Autosize; current != nil && current.Mode == autosize.Mode &&
+		(autosize.Mode == "off" || current.Maximum == autosize.Maximum) &&
+		(autosize.GrowThreshold == 0 || current.GrowThreshold == autosize.GrowThreshold) {
+		return true, nil
+	}
+
+	jobID, err := b.ontapClient.SetVolumeAutosize(ctx, id, autosize)
+	if err == nil {
+		b.steps.track(operation, "autosize", b.ontapClient, jobID)
+		auditObject(ctx, "volume", name)
+		auditJob(ctx, jobID)
+	}
+	return false, err
 }
 
 func (b *broker) Services(context context.Context) ([]brokerapi.Service, error) {
-	return b.services, nil
+	return b.catalog.services, nil
 }
 
-func (b *broker) Provision(context context.Context, instanceID string, details domain.ProvisionDetails, asyncAllowed bool) (domain.ProvisionedServiceSpec, error) {
+// encryptionPaused are the encryption states of a volume whose conversion stopped
+var encryptionPaused = map[string]bool{"conversion_paused": true, "rekey_paused": true}
+
+// applyEncryption converts the instance's volume to NVE when its plan changes to an encrypted one. Returns true once the volume is encrypted.
+func (b *broker) applyEncryption(ctx context.Context, operation, instanceID string) (bool, error) {
+	jobDone, started, err := b.steps.status(ctx, operation, "encryption")
+	if err != nil {
+		return false, err
+	}
+
+	name := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	id, err := b.ontapClient.GetVolumeIDByName(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	vol, err := b.ontapClient.GetVolumeByID(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	//the conversion keeps running after its job is done. A paused conversion doesn't continue by itself
+	if e := vol.Encryption; e != nil && e.Enabled {
+		if encryptionPaused[e.State] {
+			message := e.State
+			if e.Status != nil && e.Status.Message != "" {
+				message += ": " + e.Status.Message
+			}
+			return false, final(fmt.Errorf("Encrypting volume %s stopped: %s", name, message))
+		}
+		return e.State == "encrypted", nil
+	}
+
+	if jobDone {
+		return false, final(fmt.Errorf("Volume %s is not encrypted after the job that enables encryption succeeded", name))
+	}
+
+	if started {
+		return false, nil
+	}
+
+	jobID, err := b.ontapClient.EnableVolumeEncryption(ctx, id)
+	if err == nil {
+		b.steps.track(operation, "encryption", b.ontapClient, jobID)
+		auditObject(ctx, "volume", name)
+		auditJob(ctx, jobID)
+	}
+	return false, err
+}
+
+// applyShare creates the share of a volume that was not created through the application api
+func (b *broker) applyShare(ctx context.Context, instanceID string) (bool, error) {
+	name := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	svmID, err := b.ontapClient.SvmUUID(ctx, b.env.OntapSvmName)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = b.ontapClient.GetCifsShare(ctx, svmID, name)
+	if !errors.Is(err, ErrNotFound) {
+		return err == nil, err
+	}
+
+	if err = b.ontapClient.CreateCifsShare(ctx, b.env.OntapSvmName, name, "/"+name); err != nil {
+		return false, err
+	}
+	auditObject(ctx, "cifs-share", b.env.OntapSvmName+"/"+name)
+
+	return true, nil
+}
+
+func (b *broker) Provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, asyncAllowed bool) (_ domain.ProvisionedServiceSpec, err error) {
+	defer brokerMetrics.observeOperation("provision", time.Now(), &err)
+	defer mapFailure(&err, "provision")
+
+	ctx, logger := b.session(ctx, "provision", lager.Data{"instance-id": instanceID, "plan-id": details.PlanID})
+	defer logOutcome(logger, &err)
+
+	ctx, rec := b.audit.start(ctx, "provision", auditEvent{InstanceID: instanceID, PlanID: details.PlanID, Organization: details.OrganizationGUID, Space: details.SpaceGUID})
+	defer rec.withContext(details.RawContext).finish(&err)
+
 	if !asyncAllowed {
 		return domain.ProvisionedServiceSpec{}, apiresponses.ErrAsyncRequired
 	}
@@ -36,62 +218,199 @@ func (b *broker) Provision(context context.Context, instanceID string, details d
 	//generate the name
 	volumeName := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
 
-	//get params (sieze only for now)
-	if details.RawParameters == nil || len(details.RawParameters) == 0 {
-		return domain.ProvisionedServiceSpec{}, apiresponses.ErrRawParamsInvalid
+	if err = b.checkMaintenanceInfo(details.PlanID, details.MaintenanceInfo); err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+
+	if err = b.validateParameters(details.PlanID, instanceCreate, details.RawParameters); err != nil {
+		return domain.ProvisionedServiceSpec{}, err
 	}
 
 	var params ProvisionParameters
-	err := json.Unmarshal(details.RawParameters, &params)
+	if len(details.RawParameters) > 0 {
+		if err = json.Unmarshal(details.RawParameters, &params); err != nil {
+			return domain.ProvisionedServiceSpec{}, apiresponses.ErrRawParamsInvalid
+		}
+	}
+
+	size, err := b.volumeSize(details.PlanID, params.Size)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "validate-size")
+	}
+
+	var autosize *VolumeAutosize
+	if params.Autosize != nil {
+		a, err := b.volumeAutosize(details.PlanID, *params.Autosize, size)
+		if err != nil {
+			return domain.ProvisionedServiceSpec{}, err
+		}
+		autosize = &a
+	}
+
+	qos, err := b.desiredQos(details.PlanID, volumeName, params.Qos)
 	if err != nil {
-		return domain.ProvisionedServiceSpec{}, apiresponses.ErrRawParamsInvalid
+		return domain.ProvisionedServiceSpec{}, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "validate-qos")
 	}
 
-	size, err := stdsize.Parse(params.Size)
-	if err != nil || size < 20971520 {
-		return domain.ProvisionedServiceSpec{}, fmt.Errorf("Requested volume is smaller than smallest allowed volume")
+	settings := b.planSettings(details.PlanID)
+	if settings.Replicated && b.dr == nil {
+		return domain.ProvisionedServiceSpec{}, fmt.Errorf("Plan requires replication but no DR destination is configured")
 	}
 
-	if size > stdsize.Value(b.env.MaxVolumeSizeBytes) {
-		return domain.ProvisionedServiceSpec{}, fmt.Errorf("Requested volume size exceeds configured maximum volume size. You requested %s, Max is %s", params.Size, b.env.MaxVolumeSize)
+	if settings.Encrypted {
+		configured, err := b.ontapClient.KeyManagerConfigured(ctx)
+		if err != nil {
+			return domain.ProvisionedServiceSpec{}, fmt.Errorf("KeyManagerConfigured failed: %w", err)
+		}
+
+		if !configured {
+			return domain.ProvisionedServiceSpec{}, fmt.Errorf("Plan requires encryption but no key manager is configured on the cluster")
+		}
 	}
 
-	jobID, err := b.ontapClient.CreateCifsVolume(volumeName, b.env.OntapSvmName, int64(size))
+	//the application api creates the share along with the volume, but can't encrypt or place the volume on an aggregate
+	volumeAPI := settings.Encrypted || settings.Aggregate != ""
+
+	var jobID string
+	if volumeAPI {
+		jobID, err = b.ontapClient.CreateNasVolume(ctx, volumeName, b.env.OntapSvmName, settings.storageService(), settings.Aggregate, settings.Encrypted, size)
+	} else {
+		jobID, err = b.ontapClient.CreateCifsVolume(ctx, volumeName, b.env.OntapSvmName, settings.storageService(), size)
+	}
 	if err != nil {
-		return domain.ProvisionedServiceSpec{}, fmt.Errorf("Create Volume failed: %s", err)
+		return domain.ProvisionedServiceSpec{}, fmt.Errorf("Create Volume failed: %w", err)
 	}
+	logger.Info("volume-create-started", lager.Data{"volume": volumeName, "job-uuid": jobID, "size": size, "storage-service": settings.storageService(), "replicated": settings.Replicated, "encrypted": settings.Encrypted, "aggregate": settings.Aggregate})
+	auditObject(ctx, "volume", volumeName)
+	auditJob(ctx, jobID)
 
 	return domain.ProvisionedServiceSpec{
 		IsAsync:       true,
 		AlreadyExists: false,
 		DashboardURL:  "",
-		OperationData: jobID,
+		OperationData: operationData{JobID: jobID, Autosize: autosize, Share: volumeAPI, Replicate: settings.Replicated, Qos: qos, QosOverride: b.qosOverride(details.PlanID, params.Qos), PlanSettings: details.PlanID}.encode(),
 	}, nil
 }
 
-func (b *broker) GetInstance(ctx context.Context, instanceID string) (domain.GetInstanceDetailsSpec, error) {
-	return domain.GetInstanceDetailsSpec{}, fmt.Errorf("Instances are not retrievable")
+func (b *broker) GetInstance(ctx context.Context, instanceID string) (_ domain.GetInstanceDetailsSpec, err error) {
+	defer mapFailure(&err, "get-instance")
+
+	ctx, logger := b.session(ctx, "get-instance", lager.Data{"instance-id": instanceID})
+	defer logOutcome(logger, &err)
+
+	name := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	id, err := b.ontapClient.GetVolumeIDByName(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return domain.GetInstanceDetailsSpec{}, apiresponses.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		return domain.GetInstanceDetailsSpec{}, fmt.Errorf("error lookup volume with name %s: %w", name, err)
+	}
+
+	vol, err := b.ontapClient.GetVolumeByID(ctx, id)
+	if err != nil {
+		return domain.GetInstanceDetailsSpec{}, fmt.Errorf("GetVolumeByID failed: %w", err)
+	}
+
+	params := map[string]interface{}{
+		"size": fmt.Sprintf("%v", stdsize.Value(vol.Size)),
+	}
+
+	if vol.Autosize != nil {
+		autosize := map[string]interface{}{
+			"mode": vol.Autosize.Mode,
+		}
+		if vol.Autosize.Mode != "off" {
+			autosize["maximum"] = fmt.Sprintf("%v", stdsize.Value(vol.Autosize.Maximum))
+			autosize["grow_threshold"] = vol.Autosize.GrowThreshold
+		}
+		params["autosize"] = autosize
+	}
+
+	if vol.SnapshotPolicy != nil {
+		params["snapshot_policy"] = vol.SnapshotPolicy.Name
+	}
+
+	if vol.Qos != nil {
+		params["qos_policy"] = vol.Qos.Policy.Name
+	}
+
+	if vol.Encryption != nil {
+		params["encryption"] = map[string]interface{}{
+			"enabled": vol.Encryption.Enabled,
+			"state":   vol.Encryption.State,
+		}
+	}
+
+	//a DR outage must not break GetInstance of the instance
+	replication, err := b.replicationStatus(ctx, instanceID)
+	if err != nil {
+		logger.Error("replication-status-failed", err)
+		params["replication"] = map[string]interface{}{"error": err.Error()}
+	} else if replication != nil {
+		params["replication"] = replication
+	}
+
+	return domain.GetInstanceDetailsSpec{
+		Parameters: params,
+	}, nil
 }
 
-func (b *broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (domain.DeprovisionServiceSpec, error) {
+func (b *broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (_ domain.DeprovisionServiceSpec, err error) {
+	defer brokerMetrics.observeOperation("deprovision", time.Now(), &err)
+	defer mapFailure(&err, "deprovision")
+
+	ctx, logger := b.session(ctx, "deprovision", lager.Data{"instance-id": instanceID, "plan-id": details.PlanID})
+	defer logOutcome(logger, &err)
+
+	ctx, rec := b.audit.start(ctx, "deprovision", auditEvent{InstanceID: instanceID, PlanID: details.PlanID})
+	defer rec.finish(&err)
+
 	if !asyncAllowed {
 		return domain.DeprovisionServiceSpec{}, apiresponses.ErrAsyncRequired
 	}
 
+	rel, err := b.replicationRelationship(ctx, instanceID, details.PlanID)
+	if err != nil {
+		return domain.DeprovisionServiceSpec{}, fmt.Errorf("GetSnapmirrorRelationship failed: %w", err)
+	}
+
+	//the relationship has to go first, the volumes are deleted in LastOperation once it is gone
+	if rel != nil {
+		jobID, err := b.dr.client.DeleteSnapmirrorRelationship(ctx, rel.UUID)
+		if err != nil {
+			return domain.DeprovisionServiceSpec{}, fmt.Errorf("DeleteSnapmirrorRelationship failed: %w", err)
+		}
+		logger.Info("snapmirror-delete-started", lager.Data{"relationship": rel.UUID, "job-uuid": jobID})
+		auditObject(ctx, "snapmirror-relationship", rel.UUID)
+		auditJob(ctx, jobID)
+
+		return domain.DeprovisionServiceSpec{
+			IsAsync:       true,
+			OperationData: operationData{JobID: jobID, Teardown: true, RemoveQos: true}.encode(),
+		}, nil
+	}
+
 	name := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
-	id, err := b.ontapClient.GetVolumeIDByName(name)
+	id, err := b.ontapClient.GetVolumeIDByName(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return domain.DeprovisionServiceSpec{}, apiresponses.ErrInstanceDoesNotExist
+	}
 	if err != nil {
-		return domain.DeprovisionServiceSpec{}, fmt.Errorf("error lookup volume with name %s", name)
+		return domain.DeprovisionServiceSpec{}, fmt.Errorf("error lookup volume with name %s: %w", name, err)
 	}
 
-	jobID, err := b.ontapClient.DeleteVolume(id)
+	jobID, err := b.ontapClient.DeleteVolume(ctx, id)
 	if err != nil {
-		return domain.DeprovisionServiceSpec{}, nil
+		return domain.DeprovisionServiceSpec{}, fmt.Errorf("DeleteVolume failed: %w", err)
 	}
+	logger.Info("volume-delete-started", lager.Data{"volume": name, "job-uuid": jobID})
+	auditObject(ctx, "volume", name)
+	auditJob(ctx, jobID)
 
 	return domain.DeprovisionServiceSpec{
 		IsAsync:       true,
-		OperationData: jobID,
+		OperationData: operationData{JobID: jobID, RemoveQos: true}.encode(),
 	}, nil
 }
 
@@ -106,47 +425,87 @@ func (b *broker) hash(mountOpts map[string]interface{}) (string, error) {
 	return fmt.Sprintf("%x", md5.Sum(bytes)), nil
 }
 
-func (b *broker) Bind(context context.Context, instanceID, bindingID string, details domain.BindDetails, asyncAllowed bool) (domain.Binding, error) {
+func (b *broker) Bind(ctx context.Context, instanceID, bindingID string, details domain.BindDetails, asyncAllowed bool) (_ domain.Binding, err error) {
+	defer brokerMetrics.observeOperation("bind", time.Now(), &err)
+	defer mapFailure(&err, "bind")
+
+	ctx, logger := b.session(ctx, "bind", lager.Data{"instance-id": instanceID, "binding-id": bindingID, "plan-id": details.PlanID, "app-guid": details.AppGUID})
+	defer logOutcome(logger, &err)
+
+	ctx, rec := b.audit.start(ctx, "bind", auditEvent{InstanceID: instanceID, BindingID: bindingID, PlanID: details.PlanID})
+	defer rec.withContext(details.RawContext).finish(&err)
+
+	if err = b.validateParameters(details.PlanID, bindingCreate, details.RawParameters); err != nil {
+		return domain.Binding{}, err
+	}
+
+	var params BindParameters
+	if len(details.RawParameters) > 0 {
+		if err = json.Unmarshal(details.RawParameters, &params); err != nil {
+			return domain.Binding{}, apiresponses.ErrRawParamsInvalid
+		}
+	}
+
 	volumeName := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
 
-	username, _ := shortid.Generate()
-	password, _ := shortid.Generate()
-	err := b.ontapClient.CreateCifsUser(username, password, bindingID)
+	site, err := b.siteFor(ctx, instanceID, details.PlanID)
 	if err != nil {
-		return domain.Binding{}, fmt.Errorf("CreateCifsUser failed: %s", err)
+		return domain.Binding{}, fmt.Errorf("Unable to determine site for instance: %w", err)
 	}
 
-	svmId, err := b.ontapClient.GetSvmIdByName(b.env.OntapSvmName)
+	svmId, err := site.client.SvmUUID(ctx, site.svmName)
 	if err != nil {
-		return domain.Binding{}, fmt.Errorf("GetSvmIdByName failed: %s", err)
+		return domain.Binding{}, fmt.Errorf("SvmUUID failed: %w", err)
 	}
 
-	err = b.ontapClient.AssignCifsUser(username, svmId, volumeName)
+	username, _ := shortid.Generate()
+	password, _ := shortid.Generate()
+	err = site.client.CreateCifsUser(ctx, site.svmName, username, password, bindingID)
 	if err != nil {
-		return domain.Binding{}, fmt.Errorf("AssignCifsUser failed: %s", err)
+		return domain.Binding{}, fmt.Errorf("CreateCifsUser failed: %w", err)
 	}
+	logger.Info("cifs-user-created", lager.Data{"user": username, "svm": site.svmName})
+	auditObject(ctx, "cifs-user", site.svmName+"/"+username)
 
-	var bindOpts map[string]interface{}
-	if len(details.RawParameters) > 0 {
-		if err = json.Unmarshal(details.RawParameters, &bindOpts); err != nil {
-			return domain.Binding{}, err
+	err = site.client.AssignCifsUser(ctx, username, svmId, volumeName)
+	if err != nil {
+		return domain.Binding{}, fmt.Errorf("AssignCifsUser failed: %w", err)
+	}
+
+	var credentials interface{} = struct{}{} // if nil, cloud controller chokes on response
+	if b.credentials != nil {
+		name := b.credentialName(details.ServiceID, bindingID)
+
+		var readers []string
+		if details.AppGUID != "" {
+			readers = append(readers, "mtls-app:"+details.AppGUID)
+		}
+
+		err = b.credentials.Put(ctx, name, map[string]string{"username": username, "password": password, "source": fmt.Sprintf("//%s/%s", site.cifsHostname, volumeName)}, readers)
+		if err != nil {
+			return domain.Binding{}, fmt.Errorf("Storing credentials failed: %w", err)
 		}
+		logger.Info("credentials-stored", lager.Data{"credhub-ref": name})
+		credentials = map[string]string{"credhub-ref": name}
 	}
 
 	containerPath := fmt.Sprintf("/var/vcap/data/%s", volumeName)
-	if path, ok := bindOpts["mount"].(string); ok && path != "" {
-		containerPath = path
+	if params.Mount != "" {
+		containerPath = params.Mount
 	}
 
+	//smbdriver can't resolve credhub references, so the mount config carries the password in any case and cloud controller
+	//stores it with the binding. CredHub only keeps it out of the credentials. What limits the exposure is that every binding
+	//gets a cifs user of its own, which only has access to this share and is deleted on unbind.
 	mountConfig := make(map[string]interface{})
 	mountConfig["version"] = "3.0"
 	mountConfig["username"] = username
 	mountConfig["password"] = password
 	mountConfig["sec"] = "ntlmssp"
-	mountConfig["source"] = fmt.Sprintf("//%s/%s", b.env.CifsHostname, volumeName)
+	mountConfig["source"] = fmt.Sprintf("//%s/%s", site.cifsHostname, volumeName)
 
 	return domain.Binding{
-		Credentials: struct{}{}, // if nil, cloud controller chokes on response
+		Credentials: credentials,
 		VolumeMounts: []domain.VolumeMount{{
 			ContainerDir: containerPath,
 			Mode:         "rw",
@@ -164,42 +523,205 @@ func (b *broker) GetBinding(ctx context.Context, instanceID, bindingID string) (
 	return domain.GetBindingSpec{}, fmt.Errorf("Bindings are not retrievable")
 }
 
-func (b *broker) Unbind(context context.Context, instanceID, bindingID string, details domain.UnbindDetails, asyncAllowed bool) (domain.UnbindSpec, error) {
-	user, err := b.ontapClient.GetCifsUserByFullname(b.env.OntapSvmName, bindingID)
-	if err != nil {
-		if strings.Contains(err.Error(), "status 255") {
-			return domain.UnbindSpec{}, nil //If user not found unbind was done before but CF didn't register it.
-		}
+func (b *broker) Unbind(ctx context.Context, instanceID, bindingID string, details domain.UnbindDetails, asyncAllowed bool) (_ domain.UnbindSpec, err error) {
+	defer brokerMetrics.observeOperation("unbind", time.Now(), &err)
+	defer mapFailure(&err, "unbind")
 
-		return domain.UnbindSpec{}, fmt.Errorf("GetCifsUserByFullname failed: %s", err)
+	ctx, logger := b.session(ctx, "unbind", lager.Data{"instance-id": instanceID, "binding-id": bindingID, "plan-id": details.PlanID})
+	defer logOutcome(logger, &err)
+
+	ctx, rec := b.audit.start(ctx, "unbind", auditEvent{InstanceID: instanceID, BindingID: bindingID, PlanID: details.PlanID})
+	defer rec.finish(&err)
+
+	if b.credentials != nil {
+		name := b.credentialName(details.ServiceID, bindingID)
+		if err = b.credentials.Delete(ctx, name); err != nil {
+			return domain.UnbindSpec{}, fmt.Errorf("Deleting credentials failed: %w", err)
+		}
+		logger.Info("credentials-deleted", lager.Data{"credhub-ref": name})
 	}
 
-	err = b.ontapClient.DeleteCifsUser(user)
-	if err != nil {
-		return domain.UnbindSpec{}, fmt.Errorf("DeleteCifsUser failed: %s", err)
+	//the user is looked up on every site the binding could have been created on, a failover doesn't move existing users
+	for _, site := range b.bindingSites(details.PlanID) {
+		if err = deleteBindingUser(ctx, site, bindingID); err != nil {
+			return domain.UnbindSpec{}, err
+		}
 	}
 
 	return domain.UnbindSpec{}, nil
 }
 
-func (b *broker) Update(context context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (domain.UpdateServiceSpec, error) {
+// deleteBindingUser deletes the cifs user of the binding on the site. A missing user is not an error: the binding was created on
+// the other site or an earlier unbind wasn't registered by CF.
+func deleteBindingUser(ctx context.Context, site site, bindingID string) error {
+	logger := loggerFromContext(ctx)
+
+	user, err := site.client.GetCifsUserByFullname(ctx, site.svmName, bindingID)
+	if errors.Is(err, ErrNotFound) {
+		logger.Info("cifs-user-already-deleted", lager.Data{"svm": site.svmName})
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("GetCifsUserByFullname failed: %w", err)
+	}
 
-	return domain.UpdateServiceSpec{}, nil
+	if err = site.client.DeleteCifsUser(ctx, site.svmName, user); err != nil {
+		return fmt.Errorf("DeleteCifsUser failed: %w", err)
+	}
+	logger.Info("cifs-user-deleted", lager.Data{"user": user, "svm": site.svmName})
+	auditObject(ctx, "cifs-user", site.svmName+"/"+user)
+
+	return nil
 }
 
-func (b *broker) LastOperation(context context.Context, instanceID string, details domain.PollDetails) (domain.LastOperation, error) {
-	status, err := b.ontapClient.GetJobStatus(details.OperationData)
+func (b *broker) Update(ctx context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (_ domain.UpdateServiceSpec, err error) {
+	defer mapFailure(&err, "update")
+
+	ctx, logger := b.session(ctx, "update", lager.Data{"instance-id": instanceID, "plan-id": details.PlanID, "previous-plan-id": details.PreviousValues.PlanID})
+	defer logOutcome(logger, &err)
+
+	ctx, rec := b.audit.start(ctx, "update", auditEvent{InstanceID: instanceID, PlanID: details.PlanID})
+	defer rec.withContext(details.RawContext).finish(&err)
+
+	if err = b.checkMaintenanceInfo(details.PlanID, details.MaintenanceInfo); err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+
+	if err = b.validateParameters(details.PlanID, instanceUpdate, details.RawParameters); err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+
+	var params UpdateParameters
+	if len(details.RawParameters) > 0 {
+		if err = json.Unmarshal(details.RawParameters, &params); err != nil {
+			return domain.UpdateServiceSpec{}, apiresponses.ErrRawParamsInvalid
+		}
+	}
+
+	upgrade := isUpgrade(details)
+	planChange := details.PreviousValues.PlanID != "" && details.PreviousValues.PlanID != details.PlanID
+	if params.Autosize == nil && !upgrade && !planChange {
+		return domain.UpdateServiceSpec{}, nil
+	}
+
+	if !asyncAllowed {
+		return domain.UpdateServiceSpec{}, apiresponses.ErrAsyncRequired
+	}
+
+	name := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	id, err := b.ontapClient.GetVolumeIDByName(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return domain.UpdateServiceSpec{}, apiresponses.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		return domain.UpdateServiceSpec{}, fmt.Errorf("error lookup volume with name %s: %w", name, err)
+	}
 
+	vol, err := b.ontapClient.GetVolumeByID(ctx, id)
 	if err != nil {
-		fmt.Println(err)
+		return domain.UpdateServiceSpec{}, fmt.Errorf("GetVolumeByID failed: %w", err)
+	}
+
+	if planChange {
+		if err = b.checkPlanChange(ctx, details.PreviousValues.PlanID, details.PlanID, vol); err != nil {
+			return domain.UpdateServiceSpec{}, apiresponses.NewFailureResponse(err, http.StatusUnprocessableEntity, "plan-change")
+		}
+	}
+
+	var autosize *VolumeAutosize
+	if params.Autosize != nil {
+		a, err := b.volumeAutosize(details.PlanID, *params.Autosize, vol.Size)
+		if err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
+		autosize = &a
+	}
+
+	//the move or the policies are started right away, everything else follows in LastOperation
+	if upgrade || planChange {
+		qos := b.planQos(details.PlanID, name, vol)
+		jobID, err := b.startPlanSettings(ctx, id, name, vol, details.PlanID, qos)
+		if err != nil {
+			return domain.UpdateServiceSpec{}, fmt.Errorf("Applying plan settings failed: %w", err)
+		}
+		logger.Info("plan-settings-started", lager.Data{"volume": name, "job-uuid": jobID, "upgrade": upgrade, "plan-change": planChange})
+		auditObject(ctx, "volume", name)
+		auditJob(ctx, jobID)
+
+		encrypt := planChange && b.planSettings(details.PlanID).Encrypted && !b.planSettings(details.PreviousValues.PlanID).Encrypted
+		//a policy group of the instance left from the previous plan goes once the volume uses the policy of the new plan
+		return domain.UpdateServiceSpec{
+			IsAsync:       true,
+			OperationData: operationData{JobID: jobID, Autosize: autosize, Encrypt: encrypt, Qos: qos, RemoveQos: qos == nil, PlanSettings: details.PlanID}.encode(),
+		}, nil
+	}
+
+	jobID, err := b.ontapClient.SetVolumeAutosize(ctx, id, *autosize)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, fmt.Errorf("SetVolumeAutosize failed: %w", err)
+	}
+	logger.Info("autosize-update-started", lager.Data{"volume": name, "job-uuid": jobID})
+	auditObject(ctx, "volume", name)
+	auditJob(ctx, jobID)
+
+	return domain.UpdateServiceSpec{
+		IsAsync:       true,
+		OperationData: operationData{JobID: jobID}.encode(),
+	}, nil
+}
+
+func (b *broker) LastOperation(ctx context.Context, instanceID string, details domain.PollDetails) (lastOp domain.LastOperation, err error) {
+	op := decodeOperationData(details.OperationData)
+	ctx, logger := b.session(ctx, "last-operation", lager.Data{"instance-id": instanceID, "plan-id": details.PlanID, "operation": details.OperationData, "job-uuid": op.JobID})
+
+	ctx, rec := b.audit.start(ctx, "last-operation", auditEvent{InstanceID: instanceID, PlanID: details.PlanID, JobUUIDs: []string{op.JobID}})
+	defer rec.finishPoll(&lastOp, &err)
+	defer func() {
+		if lastOp.State != domain.InProgress {
+			b.steps.finish(op.JobID)
+		}
+	}()
+
+	status, err := b.ontapClient.GetJobStatus(ctx, op.JobID)
+	if err != nil {
+		logger.Error("get-job-status-failed", err)
 		return domain.LastOperation{
 			State:       domain.Failed,
 			Description: err.Error(),
-		}, fmt.Errorf("Getting status for job %s failed", details.OperationData)
+		}, fmt.Errorf("Getting status for job %s failed", op.JobID)
 	}
 
 	var jobStatus JobStatus
 	json.Unmarshal(status.body, &jobStatus)
+	logger.Debug("job-status", lager.Data{"state": jobStatus.State, "description": jobStatus.Description})
+
+	if statusMap[jobStatus.State] == domain.Succeeded {
+		for _, step := range b.followUps(op, instanceID) {
+			done, progress, err := step.apply(ctx)
+			if err != nil && isFinal(err) {
+				logger.Error(step.event+"-failed", err)
+				return domain.LastOperation{
+					State:       domain.Failed,
+					Description: fmt.Sprintf("%s failed: %s", step.action, err),
+				}, nil
+			}
+
+			//anything else, like an unreachable cluster, may go away. The cloud controller polls again and the step is retried
+			if err != nil {
+				logger.Error(step.event+"-retry", err)
+				return domain.LastOperation{
+					State:       domain.InProgress,
+					Description: fmt.Sprintf("%s failed, retrying: %s", step.action, err),
+				}, nil
+			}
+
+			if !done {
+				return domain.LastOperation{
+					State:       domain.InProgress,
+					Description: progress,
+				}, nil
+			}
+		}
+	}
 
 	return domain.LastOperation{
 		State:       statusMap[jobStatus.State],
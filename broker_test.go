@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+)
+
+// newLastOperationTestBroker returns a broker whose cluster reports the operation's job as succeeded, the autosize job as failed
+// and answers volume lookups with volumeStatus
+func newLastOperationTestBroker(t *testing.T, volumeStatus int) *broker {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/cluster/jobs/job-1"):
+			fmt.Fprint(w, `{"uuid":"job-1","state":"success"}`)
+		case strings.HasSuffix(r.URL.Path, "/cluster/jobs/autosize-job"):
+			fmt.Fprint(w, `{"uuid":"autosize-job","state":"failure","message":"no space left"}`)
+		case strings.HasSuffix(r.URL.Path, "/storage/volumes"):
+			w.WriteHeader(volumeStatus)
+			fmt.Fprint(w, `{"error":{"message":"cluster busy","code":"1"}}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL + "/api")
+	return &broker{
+		env:         brokerConfig{VolumeNamePrefix: "A"},
+		ontapClient: &OntapClient{URL: *u, httpClient: *server.Client()},
+		logger:      lager.NewLogger("test"),
+	}
+}
+
+func TestLastOperationRetriesTransientErrors(t *testing.T) {
+	b := newLastOperationTestBroker(t, http.StatusInternalServerError)
+	operation := operationData{JobID: "job-1", Autosize: &VolumeAutosize{Mode: "grow"}}.encode()
+
+	lastOp, err := b.LastOperation(context.Background(), testInstanceID, domain.PollDetails{OperationData: operation})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lastOp.State != domain.InProgress || !strings.Contains(lastOp.Description, "cluster busy") {
+		t.Errorf("expected the step to be retried, got %+v", lastOp)
+	}
+}
+
+func TestLastOperationFailsOnFailedJob(t *testing.T) {
+	b := newLastOperationTestBroker(t, http.StatusInternalServerError)
+	b.steps.track("job-1", "autosize", b.ontapClient, "autosize-job")
+	operation := operationData{JobID: "job-1", Autosize: &VolumeAutosize{Mode: "grow"}}.encode()
+
+	lastOp, err := b.LastOperation(context.Background(), testInstanceID, domain.PollDetails{OperationData: operation})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lastOp.State != domain.Failed || !strings.Contains(lastOp.Description, "no space left") {
+		t.Errorf("expected the operation to fail, got %+v", lastOp)
+	}
+
+	if _, tracked, _ := b.steps.status(context.Background(), "job-1", "autosize"); tracked {
+		t.Error("expected the jobs of a failed operation to be forgotten")
+	}
+}
+
+func TestApplyEncryptionFailsWhenPaused(t *testing.T) {
+	for state, failed := range map[string]bool{"encrypting": false, "conversion_paused": true, "rekey_paused": true} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/storage/volumes"):
+				fmt.Fprint(w, `{"records":[{"uuid":"vol-uuid"}],"num_records":1}`)
+			case strings.HasSuffix(r.URL.Path, "/storage/volumes/vol-uuid"):
+				fmt.Fprintf(w, `{"encryption":{"enabled":true,"state":%q,"status":{"message":"key manager unreachable"}}}`, state)
+			default:
+				t.Errorf("unexpected request %s", r.URL.Path)
+			}
+		}))
+
+		u, _ := url.Parse(server.URL + "/api")
+		b := &broker{env: brokerConfig{VolumeNamePrefix: "A"}, ontapClient: &OntapClient{URL: *u, httpClient: *server.Client()}}
+
+		done, err := b.applyEncryption(context.Background(), "job-1", testInstanceID)
+		if done || (err != nil) != failed || (failed && (!isFinal(err) || !strings.Contains(err.Error(), "key manager unreachable"))) {
+			t.Errorf("%s: expected failure %t, got done %t, %v", state, failed, done, err)
+		}
+		server.Close()
+	}
+}
+
+func TestVolumeAutosize(t *testing.T) {
+	b := &broker{env: brokerConfig{MaxVolumeSizeBytes: testMaxVolumeSize}, catalog: brokerCatalog{plans: map[string]planSettings{"plan": {}}}}
+	threshold := func(n int) *int { return &n }
+
+	for _, tc := range []struct {
+		params   AutosizeParameters
+		autosize VolumeAutosize
+		err      bool
+	}{
+		{AutosizeParameters{Mode: "off", Maximum: "big"}, VolumeAutosize{Mode: "off"}, false},
+		{AutosizeParameters{Mode: "grow"}, VolumeAutosize{Mode: "grow", Maximum: testMaxVolumeSize}, false},
+		{AutosizeParameters{Mode: "grow_shrink", Maximum: "20Gi", GrowThreshold: threshold(90)}, VolumeAutosize{Mode: "grow_shrink", Maximum: 20 << 30, GrowThreshold: 90}, false},
+		{AutosizeParameters{Mode: "grow", GrowThreshold: threshold(1)}, VolumeAutosize{Mode: "grow", Maximum: testMaxVolumeSize, GrowThreshold: 1}, false},
+		{AutosizeParameters{Mode: "grow", GrowThreshold: threshold(0)}, VolumeAutosize{}, true},
+		{AutosizeParameters{Mode: "grow", GrowThreshold: threshold(100)}, VolumeAutosize{}, true},
+		{AutosizeParameters{Mode: "grow", Maximum: "3Ti"}, VolumeAutosize{}, true},
+		{AutosizeParameters{Mode: "grow", Maximum: "5Gi"}, VolumeAutosize{}, true},
+		{AutosizeParameters{Mode: "grow", Maximum: "big"}, VolumeAutosize{}, true},
+		{AutosizeParameters{Mode: "shrink"}, VolumeAutosize{}, true},
+		{AutosizeParameters{}, VolumeAutosize{}, true},
+	} {
+		autosize, err := b.volumeAutosize("plan", tc.params, 10<<30)
+		if (err != nil) != tc.err || autosize != tc.autosize {
+			t.Errorf("%+v: expected %+v (error %t), got %+v (%v)", tc.params, tc.autosize, tc.err, autosize, err)
+		}
+	}
+}
@@ -1,25 +1,276 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/pivotal-cf/brokerapi/v7"
+	"github.com/pivotal-cf/brokerapi/v7/domain"
 )
 
-func CatalogLoad(catalogFilePath string) ([]brokerapi.Service, error) {
-	var services []brokerapi.Service
+// catalogConfig is the format of catalog.json. It is turned into the OSB catalog after validation.
+type catalogConfig struct {
+	Services []serviceConfig `json:"services"`
+}
+
+type serviceConfig struct {
+	ID                   string                `json:"id"`
+	Name                 string                `json:"name"`
+	Description          string                `json:"description"`
+	Tags                 []string              `json:"tags"`
+	Requires             []string              `json:"requires"`
+	Bindable             *bool                 `json:"bindable"`
+	InstancesRetrievable bool                  `json:"instances_retrievable"`
+	BindingsRetrievable  bool                  `json:"bindings_retrievable"`
+	PlanUpdateable       bool                  `json:"plan_updateable"`
+	Metadata             serviceMetadataConfig `json:"metadata"`
+	Plans                []planConfig          `json:"plans"`
+}
+
+type serviceMetadataConfig struct {
+	DisplayName         string `json:"display_name"`
+	LongDescription     string `json:"long_description"`
+	ProviderDisplayName string `json:"provider_display_name"`
+	DocumentationURL    string `json:"documentation_url"`
+	SupportURL          string `json:"support_url"`
+	ImageURL            string `json:"image_url"`
+	Shareable           *bool  `json:"shareable"`
+}
+
+type planConfig struct {
+	ID          string                 `json:"id"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Free        *bool                  `json:"free"`
+	Bindable    *bool                  `json:"bindable"`
+	Metadata    planMetadataConfig     `json:"metadata"`
+	Schemas     *domain.ServiceSchemas `json:"schemas"`
+	Ontap       planSettings           `json:"ontap"`
+	// MaintenanceInfo must get a new version whenever the ontap settings change, so existing instances can be upgraded
+	MaintenanceInfo *domain.MaintenanceInfo `json:"maintenance_info"`
+}
+
+type planMetadataConfig struct {
+	DisplayName string   `json:"display_name"`
+	Bullets     []string `json:"bullets"`
+}
+
+// brokerCatalog is the catalog served to the platform together with the ontap settings of each plan
+type brokerCatalog struct {
+	services    []brokerapi.Service
+	plans       map[string]planSettings
+	schemas     map[string]*domain.ServiceSchemas
+	maintenance map[string]*domain.MaintenanceInfo
+}
+
+var allowedRequires = map[string]bool{
+	string(domain.PermissionVolumeMount):     true,
+	string(domain.PermissionSyslogDrain):     true,
+	string(domain.PermissionRouteForwarding): true,
+}
 
+// CatalogLoad reads and validates the catalog config. A non-empty docsURL replaces the documentation url of every service.
+// Plan sizes must fit within maxVolumeSize (MAX_VOLUME_SIZE).
+func CatalogLoad(catalogFilePath, docsURL string, maxVolumeSize int64) (brokerCatalog, error) {
 	inBuf, err := ioutil.ReadFile(catalogFilePath)
 	if err != nil {
-		return []brokerapi.Service{}, err
+		return brokerCatalog{}, err
 	}
 
-	err = json.Unmarshal(inBuf, &services)
-	if err != nil {
-		return []brokerapi.Service{}, err
+	var config catalogConfig
+	dec := json.NewDecoder(bytes.NewReader(inBuf))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&config); err != nil {
+		return brokerCatalog{}, fmt.Errorf("Unable to parse catalog %s: %s", catalogFilePath, err)
+	}
+
+	if problems := config.validate(maxVolumeSize); len(problems) > 0 {
+		return brokerCatalog{}, fmt.Errorf("Invalid catalog %s:\n  %s", catalogFilePath, strings.Join(problems, "\n  "))
+	}
+
+	catalog := brokerCatalog{
+		plans:       make(map[string]planSettings),
+		schemas:     make(map[string]*domain.ServiceSchemas),
+		maintenance: make(map[string]*domain.MaintenanceInfo),
+	}
+	for _, s := range config.Services {
+		service := brokerapi.Service{
+			ID:                   s.ID,
+			Name:                 s.Name,
+			Description:          s.Description,
+			Bindable:             s.Bindable == nil || *s.Bindable,
+			InstancesRetrievable: s.InstancesRetrievable,
+			BindingsRetrievable:  s.BindingsRetrievable,
+			Tags:                 s.Tags,
+			PlanUpdatable:        s.PlanUpdateable,
+			Metadata: &brokerapi.ServiceMetadata{
+				DisplayName:         s.Metadata.DisplayName,
+				ImageUrl:            s.Metadata.ImageURL,
+				LongDescription:     s.Metadata.LongDescription,
+				ProviderDisplayName: s.Metadata.ProviderDisplayName,
+				DocumentationUrl:    s.Metadata.DocumentationURL,
+				SupportUrl:          s.Metadata.SupportURL,
+				Shareable:           s.Metadata.Shareable,
+			},
+		}
+
+		if docsURL != "" {
+			service.Metadata.DocumentationUrl = docsURL
+		}
+
+		for _, r := range s.Requires {
+			service.Requires = append(service.Requires, domain.RequiredPermission(r))
+		}
+
+		for _, p := range s.Plans {
+			service.Plans = append(service.Plans, brokerapi.ServicePlan{
+				ID:          p.ID,
+				Name:        p.Name,
+				Description: p.Description,
+				Free:        p.Free,
+				Bindable:    p.Bindable,
+				Metadata: &brokerapi.ServicePlanMetadata{
+					DisplayName: p.Metadata.DisplayName,
+					Bullets:     p.Metadata.Bullets,
+				},
+				Schemas:         p.Schemas,
+				MaintenanceInfo: p.MaintenanceInfo,
+			})
+			catalog.plans[p.ID] = p.Ontap
+			catalog.schemas[p.ID] = p.Schemas
+			catalog.maintenance[p.ID] = p.MaintenanceInfo
+		}
+
+		catalog.services = append(catalog.services, service)
+	}
+
+	return catalog, nil
+}
+
+// checkSchemas returns the problems of the parameter schemas of a plan, see checkSchema
+func checkSchemas(schemas *domain.ServiceSchemas) []string {
+	var problems []string
+	for _, s := range []struct {
+		name   string
+		schema map[string]interface{}
+	}{
+		{"schemas.service_instance.create", schemas.Instance.Create.Parameters},
+		{"schemas.service_instance.update", schemas.Instance.Update.Parameters},
+		{"schemas.service_binding.create", schemas.Binding.Create.Parameters},
+	} {
+		if s.schema != nil {
+			problems = append(problems, checkSchema(s.schema, s.name)...)
+		}
+	}
+
+	return problems
+}
+
+// validate returns every problem found, so a broken catalog can be fixed in one go
+// Plan sizes are parsed and plans without schemas get the default ones along the way.
+func (c *catalogConfig) validate(maxVolumeSize int64) []string {
+	var problems []string
+	ids := make(map[string]string)
+	serviceNames := make(map[string]bool)
+
+	checkID := func(id, what string) {
+		if id == "" {
+			problems = append(problems, what+" has no id")
+			return
+		}
+
+		if other, ok := ids[id]; ok {
+			problems = append(problems, fmt.Sprintf("%s has the same id as %s: %s", what, other, id))
+		}
+		ids[id] = what
+	}
+
+	checkName := func(name, what string) {
+		if name == "" {
+			problems = append(problems, what+" has no name")
+		} else if strings.ContainsAny(name, " \t\n") {
+			problems = append(problems, fmt.Sprintf("%s name %q contains whitespace", what, name))
+		}
+	}
+
+	if len(c.Services) == 0 {
+		problems = append(problems, "no services defined")
+	}
+
+	for i, s := range c.Services {
+		what := fmt.Sprintf("service %d (%s)", i+1, s.Name)
+		checkID(s.ID, what)
+		checkName(s.Name, what)
+
+		if serviceNames[s.Name] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate service name", what))
+		}
+		serviceNames[s.Name] = true
+
+		if s.Description == "" {
+			problems = append(problems, what+" has no description")
+		}
+
+		for _, r := range s.Requires {
+			if !allowedRequires[r] {
+				problems = append(problems, fmt.Sprintf("%s requires unknown permission %q", what, r))
+			}
+		}
+
+		if len(s.Plans) == 0 {
+			problems = append(problems, what+" has no plans")
+		}
+
+		planNames := make(map[string]bool)
+		for j := range s.Plans {
+			p := &s.Plans[j]
+			what := fmt.Sprintf("plan %d (%s) of service %s", j+1, p.Name, s.Name)
+			checkID(p.ID, what)
+			checkName(p.Name, what)
+
+			if planNames[p.Name] {
+				problems = append(problems, fmt.Sprintf("%s: duplicate plan name", what))
+			}
+			planNames[p.Name] = true
+
+			if p.Description == "" {
+				problems = append(problems, what+" has no description")
+			}
+
+			if p.MaintenanceInfo != nil && !semver.MatchString(p.MaintenanceInfo.Version) {
+				problems = append(problems, fmt.Sprintf("%s maintenance_info version %q is not a semantic version", what, p.MaintenanceInfo.Version))
+			}
+
+			if p.Ontap.StorageService != "" && !storageServices[p.Ontap.StorageService] {
+				problems = append(problems, fmt.Sprintf("%s has unknown storage service %q. Allowed: value, performance, extreme", what, p.Ontap.StorageService))
+			}
+
+			if p.Ontap.StorageService != "" && p.Ontap.Qos != nil {
+				problems = append(problems, fmt.Sprintf("%s has both a storage service and qos, the qos replaces the policy of the storage service", what))
+			}
+
+			if p.Ontap.Qos != nil {
+				for _, problem := range p.Ontap.Qos.validate() {
+					problems = append(problems, what+": "+problem)
+				}
+			}
+
+			for _, problem := range p.Ontap.Size.parse(maxVolumeSize) {
+				problems = append(problems, what+": "+problem)
+			}
+
+			//the built-in schemas go through the same checks as the ones from the catalog
+			if p.Schemas == nil {
+				p.Schemas = defaultSchemas(p.Ontap)
+			}
+			for _, problem := range checkSchemas(p.Schemas) {
+				problems = append(problems, what+": "+problem)
+			}
+		}
 	}
 
-	services[0].Metadata.DocumentationUrl = ""
-	return services, nil
+	return problems
 }
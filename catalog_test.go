@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCatalog = `{"services": [{
+	"id": "service-1", "name": "ontap-smb", "description": "SMB shares",
+	"metadata": {"documentation_url": "https://docs.example.com"},
+	"plans": [
+		{"id": "plan-1", "name": "small", "description": "Small share", "ontap": {"size": {"default": "10Gi", "max": "100Gi"}}},
+		{"id": "plan-2", "name": "large", "description": "Large share", "ontap": {"size": {"default": "1Ti"}, "storage_service": "performance"}}
+	]
+}]}`
+
+func writeCatalog(t *testing.T, catalog string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	if err := os.WriteFile(path, []byte(catalog), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCatalogLoad(t *testing.T) {
+	catalog, err := CatalogLoad(writeCatalog(t, testCatalog), "", testMaxVolumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(catalog.services) != 1 || len(catalog.services[0].Plans) != 2 {
+		t.Fatalf("unexpected catalog %+v", catalog.services)
+	}
+
+	if url := catalog.services[0].Metadata.DocumentationUrl; url != "https://docs.example.com" {
+		t.Errorf("expected the documentation url of the catalog without DOCSURL, got %q", url)
+	}
+
+	if catalog.plans["plan-2"].StorageService != "performance" || catalog.plans["plan-1"].Size.maxBytes != 100<<30 {
+		t.Errorf("unexpected plan settings %+v", catalog.plans)
+	}
+
+	if catalog.schemas["plan-1"] == nil {
+		t.Error("expected the default schemas for plans without schemas")
+	}
+
+	catalog, err = CatalogLoad(writeCatalog(t, testCatalog), "https://wiki.example.com", testMaxVolumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url := catalog.services[0].Metadata.DocumentationUrl; url != "https://wiki.example.com" {
+		t.Errorf("expected DOCSURL to replace the documentation url, got %q", url)
+	}
+}
+
+func TestCatalogLoadRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		replace []string
+		problem string
+	}{
+		{"unknown field", []string{`"description": "SMB shares"`, `"descripton": "SMB shares"`}, `unknown field "descripton"`},
+		{"missing description", []string{`"description": "SMB shares",`, ``}, "service 1 (ontap-smb) has no description"},
+		{"missing plan id", []string{`"id": "plan-1", `, ``}, "plan 1 (small) of service ontap-smb has no id"},
+		{"duplicate plan id", []string{`"id": "plan-2"`, `"id": "plan-1"`}, "plan 2 (large) of service ontap-smb has the same id as plan 1 (small) of service ontap-smb: plan-1"},
+		{"duplicate service and plan id", []string{`"id": "plan-1"`, `"id": "service-1"`}, "has the same id as service 1 (ontap-smb): service-1"},
+		{"duplicate plan name", []string{`"name": "large"`, `"name": "small"`}, "plan 2 (small) of service ontap-smb: duplicate plan name"},
+		{"whitespace in name", []string{`"name": "ontap-smb"`, `"name": "ontap smb"`}, `name "ontap smb" contains whitespace`},
+		{"unknown storage service", []string{`"performance"`, `"fastest"`}, `unknown storage service "fastest"`},
+		{"size above MAX_VOLUME_SIZE", []string{`"default": "1Ti"`, `"default": "1Ti", "min": "3Ti"`}, "size min 3Ti is larger than MAX_VOLUME_SIZE 2Ti"},
+		{"no services", []string{testCatalog, `{"services": []}`}, "no services defined"},
+	} {
+		catalog := strings.Replace(testCatalog, tc.replace[0], tc.replace[1], 1)
+		if catalog == testCatalog {
+			t.Fatalf("%s: replacement didn't change the catalog", tc.name)
+		}
+
+		_, err := CatalogLoad(writeCatalog(t, catalog), "", testMaxVolumeSize)
+		if err == nil || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%s: expected %q, got %v", tc.name, tc.problem, err)
+		}
+	}
+}
+
+func TestCatalogPath(t *testing.T) {
+	for key, value := range map[string]string{
+		"ONTAP_URL": "https://ontap.example.com", "ONTAP_USER": "admin", "ONTAP_PASSWORD": "secret",
+		"ONTAP_SKIP_SSL_CHECK": "false", "ONTAP_SVM_NAME": "svm1", "CIFS_HOSTNAME": "cifs.example.com",
+	} {
+		t.Setenv(key, value)
+	}
+
+	var config brokerConfig
+	if err := processWithSecrets(&config, nil); err != nil {
+		t.Fatal(err)
+	}
+	if config.CatalogPath != "./catalog.json" {
+		t.Errorf("expected the default catalog path, got %q", config.CatalogPath)
+	}
+
+	t.Setenv("CATALOG_PATH", "/etc/broker/catalog.json")
+	if err := processWithSecrets(&config, nil); err != nil {
+		t.Fatal(err)
+	}
+	if config.CatalogPath != "/etc/broker/catalog.json" {
+		t.Errorf("expected CATALOG_PATH to override the catalog path, got %q", config.CatalogPath)
+	}
+}
+
+func TestShippedCatalogIsValid(t *testing.T) {
+	if _, err := CatalogLoad("catalog.json", "", testMaxVolumeSize); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCatalogLoadRejectsUnsupportedSchemas(t *testing.T) {
+	catalog := strings.Replace(testCatalog, `"description": "Small share", `, `"description": "Small share", "schemas": {"service_instance": {"create": {"parameters": {"type": "object", "properties": {"size": {"type": "string", "format": "size"}}}}}}, `, 1)
+
+	_, err := CatalogLoad(writeCatalog(t, catalog), "", testMaxVolumeSize)
+	if err == nil || !strings.Contains(err.Error(), "schemas.service_instance.create.size: unsupported keyword format") {
+		t.Errorf("expected the format keyword to be rejected, got %v", err)
+	}
+}
@@ -2,32 +2,111 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"toolman.org/numbers/stdsize"
 )
 
 type brokerConfig struct {
-	BrokerUsername     string `envconfig:"broker_username" required:"true"`
-	BrokerPassword     string `envconfig:"broker_password" required:"true"`
-	OntapURL           string `envconfig:"ontap_url" required:"true"`
-	OntapUser          string `envconfig:"ontap_user" required:"true"`
-	OntapPassword      string `envconfig:"ontap_password" required:"true"`
-	OntapSkipSSLCheck  bool   `envconfig:"ontap_skip_ssl_check" required:"true"`
-	OntapSvmName       string `envconfig:"ontap_svm_name" required:"true"`
-	CifsHostname       string `envconfig:"cifs_hostname" required:"true"`
-	TrustedSSHKey      string `envconfig:"trusted_ssh_key" default:""`
-	MaxVolumeSize      string `envconfig:"max_volume_size" default:"2Ti"`
-	MaxVolumeSizeBytes int64
-	VolumeNamePrefix   string `envconfig:"volume_name_prefix" default:"A"` //We use the service UUID as the volume name but ontapp volumes cannot start with a number so we have to prefix the uuid
-	LogLevel           string `envconfig:"log_level" default:"INFO"`
-	Port               string `envconfig:"port" default:"3000"`
-	DocsURL            string `envconfig:"docsurl" default:"default"`
+	BrokerUsername            string        `envconfig:"broker_username" default:""` //user with all roles, in addition to BROKER_USERS
+	BrokerPassword            string        `envconfig:"broker_password" default:""`
+	BrokerUsers               string        `envconfig:"broker_users" default:""` //json list of {"username", "password" (plain or bcrypt), "client_cert_cn", "roles": ["broker", "operator"]}
+	Users                     []brokerUser  `ignored:"true"`
+	TLSCert                   string        `envconfig:"tls_cert" default:""` //serve https with this certificate, PEM data or path to a PEM file
+	TLSKey                    string        `envconfig:"tls_key" default:""`
+	TLSClientCA               string        `envconfig:"tls_client_ca" default:""`                    //CA for client certificates of users with a client_cert_cn
+	TrustForwardedClientCert  bool          `envconfig:"trust_forwarded_client_cert" default:"false"` //take client certificates from X-Forwarded-Client-Cert. Only enable when the broker can't be reached without the router that sets it, e.g. gorouter with forwarded_client_cert: sanitize_set
+	OntapURL                  string        `envconfig:"ontap_url" required:"true"`
+	OntapUser                 string        `envconfig:"ontap_user" required:"true"`
+	OntapPassword             string        `envconfig:"ontap_password" required:"true"`
+	OntapSkipSSLCheck         bool          `envconfig:"ontap_skip_ssl_check" required:"true"`
+	OntapCACert               string        `envconfig:"ontap_ca_cert" default:""`     //PEM data or path to a PEM file
+	OntapClientCert           string        `envconfig:"ontap_client_cert" default:""` //when set the api is accessed with certificate based login instead of basic auth
+	OntapClientKey            string        `envconfig:"ontap_client_key" default:""`
+	OntapTLSMinVersion        string        `envconfig:"ontap_tls_min_version" default:"1.2"`
+	OntapConnectTimeout       time.Duration `envconfig:"ontap_connect_timeout" default:"10s"`
+	OntapReadTimeout          time.Duration `envconfig:"ontap_read_timeout" default:"60s"` //time to wait for response headers, long running operations are async jobs
+	OntapRetryAttempts        int           `envconfig:"ontap_retry_attempts" default:"3"`
+	OntapRetryBaseDelay       time.Duration `envconfig:"ontap_retry_base_delay" default:"1s"`
+	OntapRetryMaxDelay        time.Duration `envconfig:"ontap_retry_max_delay" default:"30s"`
+	OntapRetryableErrorCodes  []string      `envconfig:"ontap_retryable_error_codes" default:"13303812,917536"` //comma separated ontap error codes that are always retried, defaults to transient busy errors
+	OntapSvmName              string        `envconfig:"ontap_svm_name" required:"true"`
+	CifsHostname              string        `envconfig:"cifs_hostname" required:"true"`
+	TrustedSSHKey             string        `envconfig:"trusted_ssh_key" default:""` //one or more keys or SHA256 fingerprints, separated by newlines or commas
+	SSHKnownHostsFile         string        `envconfig:"ssh_known_hosts_file" default:""`
+	SSHPort                   int           `envconfig:"ssh_port" default:"22"`
+	SSHKeepalive              time.Duration `envconfig:"ssh_keepalive" default:"30s"`
+	SSHMaxIdle                int           `envconfig:"ssh_max_idle" default:"4"` //number of idle ssh connections kept open per cluster
+	SSHCommandTimeout         time.Duration `envconfig:"ssh_command_timeout" default:"60s"`
+	SSHStrictHostKey          bool          `envconfig:"ssh_strict_host_key" default:"false"` //refuse to start without host key verification
+	MaxVolumeSize             string        `envconfig:"max_volume_size" default:"2Ti"`
+	MaxVolumeSizeBytes        int64
+	VolumeNamePrefix          string        `envconfig:"volume_name_prefix" default:"A"` //We use the service UUID as the volume name but ontapp volumes cannot start with a number so we have to prefix the uuid
+	LogLevel                  string        `envconfig:"log_level" default:"INFO"`
+	Port                      string        `envconfig:"port" default:"3000"`
+	DocsURL                   string        `envconfig:"docsurl" default:""` //overrides the documentation_url of the services in the catalog
+	CatalogPath               string        `envconfig:"catalog_path" default:"./catalog.json"`
+	MetricsCacheTTL           time.Duration `envconfig:"metrics_cache_ttl" default:"60s"`
+	CapabilityRefreshInterval time.Duration `envconfig:"capability_refresh_interval" default:"1h"`
+	HealthCheckTimeout        time.Duration `envconfig:"health_check_timeout" default:"20s"`
+	HealthCheckCacheTTL       time.Duration `envconfig:"health_check_cache_ttl" default:"15s"`
+	ShutdownTimeout           time.Duration `envconfig:"shutdown_timeout" default:"8s"` //cf kills the app 10s after SIGTERM
+	AuditLog                  string        `envconfig:"audit_log" default:""`          //stdout, a file path for JSON lines, or syslog[+tcp]://host:port for CEF. Empty disables the audit trail
+
+	//when CREDHUB_URL is set the app gets the cifs credentials through a credhub-ref. The volume mount still contains the
+	//password because smbdriver can't resolve credhub references, so this does not keep the password out of Cloud Controller
+	CredhubURL          string `envconfig:"credhub_url" default:""`
+	CredhubCACert       string `envconfig:"credhub_ca_cert" default:""`
+	CredhubClient       string `envconfig:"credhub_client" default:""` //UAA client, the CF instance identity certificate is used when empty
+	CredhubClientSecret string `envconfig:"credhub_client_secret" default:""`
+	CredhubSkipSSLCheck bool   `envconfig:"credhub_skip_ssl_check" default:"false"`
+	CredhubPathPrefix   string `envconfig:"credhub_path_prefix" default:"/c/cf-ontapsmb-broker"`
+
+	//DR destination for replicated plans. Replication is disabled when DR_ONTAP_URL is empty
+	DrOntapURL          string `envconfig:"dr_ontap_url" default:""`
+	DrOntapUser         string `envconfig:"dr_ontap_user" default:""`
+	DrOntapPassword     string `envconfig:"dr_ontap_password" default:""`
+	DrSvmName           string `envconfig:"dr_svm_name" default:""`
+	DrCifsHostname      string `envconfig:"dr_cifs_hostname" default:""`
+	DrTrustedSSHKey     string `envconfig:"dr_trusted_ssh_key" default:""`
+	DrSSHKnownHostsFile string `envconfig:"dr_ssh_known_hosts_file" default:""`
+	DrOntapSkipSSLCheck bool   `envconfig:"dr_ontap_skip_ssl_check" default:"false"`
+	DrOntapCACert       string `envconfig:"dr_ontap_ca_cert" default:""`
+	DrSnapmirrorPolicy  string `envconfig:"dr_snapmirror_policy" default:"MirrorAllSnapshots"`
+	DrTransferSchedule  string `envconfig:"dr_transfer_schedule" default:"hourly"`
+}
+
+// processMu serializes config loads, the secrets are in the environment while envconfig runs
+var processMu sync.Mutex
+
+// processWithSecrets fills spec with envconfig. The resolved secrets are only in the environment while envconfig reads it,
+// the environment itself wins over them.
+func processWithSecrets(spec interface{}, secrets map[string]string) error {
+	processMu.Lock()
+	defer processMu.Unlock()
+
+	for key, value := range secrets {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	return envconfig.Process("", spec)
 }
 
 func brokerConfigLoad() (brokerConfig, error) {
+	secrets, err := resolveSecrets()
+	if err != nil {
+		return brokerConfig{}, err
+	}
+
 	var config brokerConfig
-	err := envconfig.Process("", &config)
+	err = processWithSecrets(&config, secrets)
 	if err != nil {
 		return brokerConfig{}, err
 	}
@@ -38,11 +117,36 @@ func brokerConfigLoad() (brokerConfig, error) {
 		return brokerConfig{}, fmt.Errorf("Unable to parse MAX_VOLUME_SIZE. Allowed modifiers: K,M,G,T,P,Ki,Mi,Gi,Ti,Pi")
 	}
 
-	if size < 20971520 {
+	if size < minVolumeSize {
 		return brokerConfig{}, fmt.Errorf("MAX_VOLUME_SIZE too small")
 	}
 
 	config.MaxVolumeSizeBytes = int64(size)
 
+	config.Users, err = parseBrokerUsers(config.BrokerUsers, config.BrokerUsername, config.BrokerPassword)
+	if err != nil {
+		return brokerConfig{}, err
+	}
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return brokerConfig{}, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+
+	if config.TLSClientCA != "" && config.TLSCert == "" && !config.TrustForwardedClientCert {
+		return brokerConfig{}, fmt.Errorf("TLS_CLIENT_CA requires TLS_CERT and TLS_KEY, or TRUST_FORWARDED_CLIENT_CERT")
+	}
+
+	if config.TrustForwardedClientCert && config.TLSClientCA == "" {
+		return brokerConfig{}, fmt.Errorf("TRUST_FORWARDED_CLIENT_CERT requires TLS_CLIENT_CA to verify the forwarded certificates")
+	}
+
+	if (config.OntapClientCert == "") != (config.OntapClientKey == "") {
+		return brokerConfig{}, fmt.Errorf("ONTAP_CLIENT_CERT and ONTAP_CLIENT_KEY must be set together")
+	}
+
+	if config.DrOntapURL != "" && (config.DrOntapUser == "" || config.DrOntapPassword == "" || config.DrSvmName == "" || config.DrCifsHostname == "") {
+		return brokerConfig{}, fmt.Errorf("DR_ONTAP_URL is set but DR_ONTAP_USER, DR_ONTAP_PASSWORD, DR_SVM_NAME or DR_CIFS_HOSTNAME is missing")
+	}
+
 	return config, nil
 }
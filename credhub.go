@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CredentialStore holds the binding credentials apps read through the credhub-ref returned in the binding. The platform resolves the reference.
+// This does not keep the password out of the cloud controller database: smbdriver needs it in the mount config of the volume
+// mount, which is stored with the binding. Until smbdriver can resolve credhub references that can't be changed by the broker.
+type CredentialStore interface {
+	// Put stores value under name and grants read access to the actors, e.g. mtls-app:<app guid>
+	Put(ctx context.Context, name string, value interface{}, readers []string) error
+	// Delete removes the credential. A missing credential is not an error.
+	Delete(ctx context.Context, name string) error
+}
+
+// CredhubOptions configures the credhub client. Without a UAA client the CF instance identity certificate is used for mTLS.
+type CredhubOptions struct {
+	URL          string
+	CACert       string //PEM data or path to a PEM file
+	Client       string
+	ClientSecret string
+	SkipVerify   bool
+}
+
+// NewCredentialStore returns nil when credhub is not configured. The url "memory" gives a store that only lives in the broker process, for local development.
+func NewCredentialStore(options CredhubOptions) (CredentialStore, error) {
+	switch options.URL {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryCredentialStore(), nil
+	}
+
+	client, err := newCredhubClient(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// credentialName follows the OSB convention for credhub references: /c/<broker>/<service>/<binding>/credentials
+func (b *broker) credentialName(serviceID, bindingID string) string {
+	return fmt.Sprintf("%s/%s/%s/credentials", strings.TrimRight(b.env.CredhubPathPrefix, "/"), serviceID, bindingID)
+}
+
+type memoryCredentialStore struct {
+	mu          sync.Mutex
+	credentials map[string]interface{}
+}
+
+func newMemoryCredentialStore() *memoryCredentialStore {
+	return &memoryCredentialStore{credentials: make(map[string]interface{})}
+}
+
+func (m *memoryCredentialStore) Put(_ context.Context, name string, value interface{}, _ []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.credentials[name] = value
+	return nil
+}
+
+func (m *memoryCredentialStore) Delete(_ context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.credentials, name)
+	return nil
+}
+
+type credhubClient struct {
+	url          url.URL
+	httpClient   http.Client
+	client       string
+	clientSecret string
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func newCredhubClient(options CredhubOptions) (*credhubClient, error) {
+	u, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing CredHub URL: %s", err)
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: options.SkipVerify}
+	if options.CACert != "" {
+		pem, err := readPEM(options.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CredHub CA certificate: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No valid certificates found in CredHub CA certificate")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if options.Client == "" {
+		certFile, keyFile := os.Getenv("CF_INSTANCE_CERT"), os.Getenv("CF_INSTANCE_KEY")
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("CredHub needs either a UAA client or the CF instance identity certificate")
+		}
+
+		//the instance identity certificate is rotated by diego so it is read again for every handshake
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			return &cert, err
+		}
+	}
+
+	return &credhubClient{
+		url:          *u,
+		httpClient:   http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: cfg}, Timeout: 30 * time.Second},
+		client:       options.Client,
+		clientSecret: options.ClientSecret,
+	}, nil
+}
+
+func (c *credhubClient) Put(ctx context.Context, name string, value interface{}, readers []string) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"name":  name,
+		"type":  "json",
+		"value": value,
+	})
+
+	if _, err := c.do(ctx, http.MethodPut, "/api/v1/data", nil, body, http.StatusOK); err != nil {
+		return fmt.Errorf("Storing credential %s failed: %w", name, err)
+	}
+
+	for _, actor := range readers {
+		body, _ := json.Marshal(map[string]interface{}{
+			"path":       name,
+			"actor":      actor,
+			"operations": []string{"read"},
+		})
+
+		if _, err := c.do(ctx, http.MethodPost, "/api/v2/permissions", nil, body, http.StatusCreated); err != nil && !isStatus(err, http.StatusConflict) {
+			return fmt.Errorf("Granting %s read access to %s failed: %w", actor, name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *credhubClient) Delete(ctx context.Context, name string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/api/v1/data", url.Values{"name": {name}}, nil, http.StatusNoContent)
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("Deleting credential %s failed: %w", name, err)
+	}
+
+	return nil
+}
+
+type credhubError struct {
+	statusCode int
+	message    string
+}
+
+func (e credhubError) Error() string {
+	return fmt.Sprintf("Status code: %d, Message: %s", e.statusCode, e.message)
+}
+
+func isStatus(err error, status int) bool {
+	ce, ok := err.(credhubError)
+	return ok && ce.statusCode == status
+}
+
+func (c *credhubClient) do(ctx context.Context, method, path string, query url.Values, body []byte, expected int) ([]byte, error) {
+	u := c.url
+	u.Path = strings.TrimRight(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if c.client != "" {
+		token, err := c.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error doing http request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != expected {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(data, &e)
+		return nil, credhubError{statusCode: resp.StatusCode, message: e.Error}
+	}
+
+	return data, nil
+}
+
+// accessToken gets a client credentials token from the UAA credhub points to in /info, and caches it until shortly before it expires
+func (c *credhubClient) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	u := c.url
+	u.Path = strings.TrimRight(u.Path, "/") + "/info"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error getting CredHub info: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var info struct {
+		AuthServer struct {
+			URL string `json:"url"`
+		} `json:"auth-server"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil || info.AuthServer.URL == "" {
+		return "", fmt.Errorf("CredHub info doesn't contain an auth server")
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(info.AuthServer.URL, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.client), url.QueryEscape(c.clientSecret))
+
+	tokenResp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error getting UAA token: %w", err)
+	}
+	defer tokenResp.Body.Close()
+
+	if tokenResp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error getting UAA token: status code %d", tokenResp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.NewDecoder(tokenResp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("Error decoding UAA token: %s", err)
+	}
+
+	c.token = token.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+
+	return c.token, nil
+}
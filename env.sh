@@ -7,4 +7,8 @@ export ONTAP_SKIP_SSL_CHECK="true"
 export ONTAP_SVM_NAME="svm0"
 export CIFS_HOSTNAME="172.16.3.102"
 export TRUSTED_SSH_KEY="ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBFeijwHmvJ2hR3izMv8KOAb+h8JqA92/SOGQvcwmUI3FBf+SYW1eWt44tCAOoKeJZsWKPnVP/aEtc4EKiU3jzXc="
-export DOCSURL="http://localhost"
\ No newline at end of file
+export DOCSURL="http://localhost"
+# Any variable can instead be read from a file with <NAME>_FILE, e.g. ONTAP_PASSWORD_FILE=/secrets/ontap_password,
+# or from the credentials of a bound service named or tagged ontapsmb-broker-config (CONFIG_SERVICE_NAME). Send SIGHUP to reload credentials.
+# More users with roles (broker, operator), passwords may be bcrypt hashes:
+# export BROKER_USERS='[{"username":"ops","password":"$2a$10$...","roles":["operator"]}]'
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// Sentinel errors for ontap api and cli failures. Match them with errors.Is, the underlying OntapError or CommandError is available through errors.As.
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrAlreadyExists    = errors.New("already exists")
+	ErrDuplicate        = errors.New("duplicate entry")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// ontap error codes with a fixed meaning
+const ontapCodeEntryDoesntExist = "4"
+
+func (e OntapError) Is(target error) bool {
+	message := strings.ToLower(e.body.Error.Message)
+
+	switch target {
+	case ErrNotFound:
+		return e.statusCode == http.StatusNotFound || e.body.Error.Code == ontapCodeEntryDoesntExist
+	case ErrAlreadyExists:
+		return e.statusCode == http.StatusConflict || strings.Contains(message, "already exists")
+	case ErrDuplicate:
+		return strings.Contains(message, "duplicate entry")
+	case ErrPermissionDenied:
+		return e.statusCode == http.StatusUnauthorized || e.statusCode == http.StatusForbidden
+	}
+
+	return false
+}
+
+// Code returns the ontap error code
+func (e OntapError) Code() string {
+	return e.body.Error.Code
+}
+
+// StatusCode returns the http status code of the response
+func (e OntapError) StatusCode() int {
+	return e.statusCode
+}
+
+// CommandError is returned when a cli command exits non-zero
+type CommandError struct {
+	Cmd    string
+	Result SSHResult
+	err    error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("Command %q failed: %s: %s", e.Cmd, e.err, strings.TrimSpace(e.Result.Stdout+e.Result.Stderr))
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.err
+}
+
+// cliNoEntries is what show commands print when nothing matches the query
+const cliNoEntries = "there are no entries matching your query"
+
+// Is maps the cli output to the sentinel errors. Only the output of a show command without matches counts as not found,
+// exit statuses and other messages are too unspecific.
+func (e *CommandError) Is(target error) bool {
+	output := strings.ToLower(e.Result.Stdout + e.Result.Stderr)
+
+	switch target {
+	case ErrNotFound:
+		return strings.Contains(output, cliNoEntries)
+	case ErrAlreadyExists:
+		return strings.Contains(output, "already exists")
+	case ErrDuplicate:
+		return strings.Contains(output, "duplicate entry")
+	case ErrPermissionDenied:
+		return strings.Contains(output, "not authorized") || strings.Contains(output, "insufficient privileges")
+	}
+
+	return false
+}
+
+// finalError marks an error that fails an operation for good, e.g. an ontap job that failed. Polling again doesn't change it.
+type finalError struct {
+	err error
+}
+
+func (e finalError) Error() string {
+	return e.err.Error()
+}
+
+func (e finalError) Unwrap() error {
+	return e.err
+}
+
+func final(err error) error {
+	return finalError{err: err}
+}
+
+// isFinal reports whether retrying can't fix err: it is marked final, or the broker's ontap user lacks a privilege
+func isFinal(err error) bool {
+	var f finalError
+	return errors.As(err, &f) || errors.Is(err, ErrPermissionDenied)
+}
+
+// failureResponse maps err to a brokerapi FailureResponse with a matching http status code. Errors that are already a FailureResponse are returned as is.
+// ErrPermissionDenied stays a 500: it means the broker's own ontap user lacks a privilege, not that the platform may not do the request.
+// OSB only defines 404 for requests on existing resources. When provision or bind miss something they depend on, e.g. the share
+// of the instance, that is a 422.
+func failureResponse(err error, loggerAction string) error {
+	var fr *apiresponses.FailureResponse
+	if err == nil || errors.As(err, &fr) {
+		return err
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound) && (loggerAction == "provision" || loggerAction == "bind"):
+		status = http.StatusUnprocessableEntity
+		err = fmt.Errorf("A resource the %s depends on doesn't exist: %w", loggerAction, err)
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrAlreadyExists), errors.Is(err, ErrDuplicate):
+		status = http.StatusConflict
+	}
+
+	return apiresponses.NewFailureResponse(err, status, loggerAction)
+}
+
+// mapFailure is meant to be deferred by broker methods with a named error result
+func mapFailure(err *error, loggerAction string) {
+	*err = failureResponse(*err, loggerAction)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+func TestCommandErrorNotFound(t *testing.T) {
+	for output, notFound := range map[string]bool{
+		"There are no entries matching your query.":                                  true,
+		"Error: command failed: Volume \"vol1\" in Vserver \"svm1\" does not exist.": false,
+		"Error: Killed": false,
+	} {
+		err := &CommandError{Cmd: "show", Result: SSHResult{Stdout: output, ExitStatus: 255}, err: errors.New("exit status 255")}
+		if errors.Is(err, ErrNotFound) != notFound {
+			t.Errorf("%q: expected not found %t", output, notFound)
+		}
+	}
+}
+
+func TestFailureResponseStatus(t *testing.T) {
+	notFound := fmt.Errorf("lookup failed: %w", OntapError{statusCode: http.StatusNotFound})
+	for _, tc := range []struct {
+		err    error
+		action string
+		status int
+	}{
+		{notFound, "get-instance", http.StatusNotFound},
+		{notFound, "unbind", http.StatusNotFound},
+		{notFound, "provision", http.StatusUnprocessableEntity},
+		{notFound, "bind", http.StatusUnprocessableEntity},
+		{OntapError{statusCode: http.StatusConflict}, "provision", http.StatusConflict},
+		{OntapError{statusCode: http.StatusForbidden}, "provision", http.StatusInternalServerError},
+		{&CommandError{Result: SSHResult{Stderr: "Error: not authorized for that command"}, err: errors.New("exit status 1")}, "bind", http.StatusInternalServerError},
+		{errors.New("boom"), "provision", http.StatusInternalServerError},
+	} {
+		var fr *apiresponses.FailureResponse
+		if !errors.As(failureResponse(tc.err, tc.action), &fr) {
+			t.Fatalf("%v: not a FailureResponse", tc.err)
+		}
+
+		if status := fr.ValidatedStatusCode(nil); status != tc.status {
+			t.Errorf("%v on %s: expected %d, got %d", tc.err, tc.action, tc.status, status)
+		}
+	}
+}
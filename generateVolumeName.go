@@ -2,9 +2,23 @@ package main
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 )
 
+// instanceIDPattern matches what generateVolumeName makes of a cloud controller instance guid
+var instanceIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}_[0-9a-fA-F]{4}_[0-9a-fA-F]{4}_[0-9a-fA-F]{4}_[0-9a-fA-F]{12}$`)
+
 func generateVolumeName(prefix, id string) string {
 	return fmt.Sprintf("%s%s", prefix, strings.ReplaceAll(id, "-", "_"))
 }
+
+// isInstanceVolumeName tells the volumes of the broker apart from other volumes on the svm that happen to start with the prefix
+func isInstanceVolumeName(prefix, name string) bool {
+	return strings.HasPrefix(name, prefix) && instanceIDPattern.MatchString(strings.TrimPrefix(name, prefix))
+}
+
+// instanceIDFromVolumeName reverses generateVolumeName
+func instanceIDFromVolumeName(prefix, name string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(name, prefix), "_", "-")
+}
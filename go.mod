@@ -4,6 +4,7 @@ go 1.19
 
 require (
 	code.cloudfoundry.org/lager v2.0.0+incompatible
+	github.com/gorilla/mux v1.8.0
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/pivotal-cf/brokerapi/v7 v7.5.0
 	github.com/teris-io/shortid v0.0.0-20201117134242-e59966efd125
@@ -13,7 +14,6 @@ require (
 
 require (
 	github.com/google/uuid v1.1.0 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/pborman/uuid v0.0.0-20180906182336-adf5a7427709 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
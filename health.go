@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+	// optional checks are reported but don't make the broker unhealthy or unready
+	optional bool
+}
+
+// errCheckSkipped is returned by checks that don't apply to the cluster
+var errCheckSkipped = errors.New("skipped")
+
+type checkResult struct {
+	Name     string `json:"name"`
+	Healthy  bool   `json:"healthy"`
+	Optional bool   `json:"optional,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type healthReport struct {
+	Healthy  bool          `json:"healthy"`
+	Degraded bool          `json:"degraded"` //an optional check failed
+	Checked  time.Time     `json:"checked"`
+	Checks   []checkResult `json:"checks"`
+}
+
+// siteChecks verifies everything the broker needs from a site: api credentials, the svm, the cifs server and ssh including the host key.
+// SSH is only checked when the cluster is too old to manage cifs users over the api.
+func siteChecks(prefix string, s site, optional bool) []healthCheck {
+	return []healthCheck{
+		{prefix + "-api", func(ctx context.Context) error {
+			_, err := s.client.getClusterVersion(ctx)
+			return err
+		}, optional},
+		{prefix + "-svm", func(ctx context.Context) error {
+			_, err := s.client.GetSvmIdByName(ctx, s.svmName)
+			return err
+		}, optional},
+		{prefix + "-cifs-server", func(ctx context.Context) error {
+			enabled, err := s.client.CifsServerEnabled(ctx, s.svmName)
+			if err == nil && !enabled {
+				err = fmt.Errorf("CIFS server on svm %s is not enabled", s.svmName)
+			}
+			return err
+		}, optional},
+		{prefix + "-ssh", func(ctx context.Context) error {
+			if s.client.Capabilities().RestCifsLocalUsers {
+				return errCheckSkipped
+			}
+			return s.client.CheckSSH(ctx)
+		}, optional},
+	}
+}
+
+// healthChecks checks the primary site and, as optional checks, the DR site. Only replicated plans need the DR site
+// so an outage there must not take the broker out of service.
+func (b *broker) healthChecks() []healthCheck {
+	checks := siteChecks("ontap", b.primarySite(), false)
+	if b.dr != nil {
+		checks = append(checks, siteChecks("dr-ontap", *b.dr, true)...)
+	}
+
+	return checks
+}
+
+// healthChecker runs the checks concurrently and caches the report so probes don't hammer the cluster.
+// The checks don't run on the context of a probe: a probe that gives up must not fail the checks and get that report cached.
+type healthChecker struct {
+	checks  []healthCheck
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	report  *healthReport
+	running chan struct{} //closed when the checks in progress are done
+}
+
+func newHealthChecker(checks []healthCheck, timeout, ttl time.Duration) *healthChecker {
+	return &healthChecker{
+		checks:  checks,
+		timeout: timeout,
+		ttl:     ttl,
+	}
+}
+
+// run returns the cached report and starts the checks when it is outdated. Until the checks are done the outdated report is returned,
+// the first report is waited for as long as ctx allows.
+func (h *healthChecker) run(ctx context.Context) healthReport {
+	h.mu.Lock()
+	if h.report != nil && time.Since(h.report.Checked) < h.ttl {
+		report := *h.report
+		h.mu.Unlock()
+		return report
+	}
+
+	if h.running == nil {
+		h.running = make(chan struct{})
+		go h.check(h.running)
+	}
+	running, previous := h.running, h.report
+	h.mu.Unlock()
+
+	if previous != nil {
+		return *previous
+	}
+
+	select {
+	case <-running:
+	case <-ctx.Done():
+		return healthReport{Checked: time.Now()}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return *h.report
+}
+
+// check runs all checks and caches the report
+func (h *healthChecker) check(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	report := healthReport{
+		Healthy: true,
+		Checked: time.Now(),
+		Checks:  make([]checkResult, len(h.checks)),
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range h.checks {
+		wg.Add(1)
+		go func(i int, c healthCheck) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := c.check(ctx)
+			skipped := errors.Is(err, errCheckSkipped)
+			report.Checks[i] = checkResult{
+				Name:     c.name,
+				Healthy:  err == nil || skipped,
+				Optional: c.optional,
+				Skipped:  skipped,
+				Duration: time.Since(start).String(),
+			}
+			if err != nil && !skipped {
+				report.Checks[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, r := range report.Checks {
+		if r.Optional {
+			report.Degraded = report.Degraded || !r.Healthy
+		} else {
+			report.Healthy = report.Healthy && r.Healthy
+		}
+	}
+
+	h.mu.Lock()
+	h.report = &report
+	h.running = nil
+	h.mu.Unlock()
+	close(done)
+}
+
+// failures returns a single error describing all failed checks that are not optional
+func (r healthReport) failures() error {
+	var failed []string
+	for _, c := range r.Checks {
+		if !c.Healthy && !c.Optional {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Error))
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("Startup checks failed: %s", strings.Join(failed, "; "))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// healthzHandler reports the process is alive. It doesn't touch the cluster so a filer outage doesn't get the broker restarted.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+func (r healthReport) statusCode() int {
+	if !r.Healthy {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusOK
+}
+
+// readyCheck is what the unauthenticated readiness probe tells about a check
+type readyCheck struct {
+	Name     string `json:"name"`
+	Healthy  bool   `json:"healthy"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// readyzHandler answers the platform's readiness probe with 503 when a check that isn't optional fails. It is unauthenticated,
+// so it lists the checks without their errors, which name hosts. Operators get those through healthReportHandler.
+func readyzHandler(h *healthChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.run(r.Context())
+
+		status := "ready"
+		if !report.Healthy {
+			status = "unavailable"
+		}
+
+		checks := make([]readyCheck, len(report.Checks))
+		for i, c := range report.Checks {
+			checks[i] = readyCheck{Name: c.Name, Healthy: c.Healthy, Optional: c.Optional}
+		}
+
+		writeJSON(w, report.statusCode(), map[string]interface{}{"status": status, "degraded": report.Degraded, "checks": checks})
+	})
+}
+
+// healthReportHandler reports the status of every dependency
+func healthReportHandler(h *healthChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.run(r.Context())
+		writeJSON(w, report.statusCode(), report)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerOptionalChecks(t *testing.T) {
+	failing := func(context.Context) error { return errors.New("unreachable") }
+	ok := func(context.Context) error { return nil }
+	skipped := func(context.Context) error { return errCheckSkipped }
+
+	report := newHealthChecker([]healthCheck{
+		{name: "ontap-api", check: ok},
+		{name: "ontap-ssh", check: skipped},
+		{name: "dr-ontap-api", check: failing, optional: true},
+	}, time.Second, 0).run(context.Background())
+
+	if !report.Healthy || !report.Degraded {
+		t.Errorf("expected healthy and degraded, got %+v", report)
+	}
+
+	if !report.Checks[1].Skipped || !report.Checks[1].Healthy {
+		t.Errorf("expected a skipped check, got %+v", report.Checks[1])
+	}
+
+	if err := report.failures(); err != nil {
+		t.Errorf("optional failures must not fail startup: %s", err)
+	}
+
+	report = newHealthChecker([]healthCheck{
+		{name: "ontap-api", check: failing},
+	}, time.Second, 0).run(context.Background())
+
+	if report.Healthy || report.failures() == nil {
+		t.Errorf("expected a failure, got %+v", report)
+	}
+}
+
+func TestReadyzListsChecksWithoutErrors(t *testing.T) {
+	h := newHealthChecker([]healthCheck{
+		{name: "ontap-api", check: func(context.Context) error { return nil }},
+		{name: "dr-ontap-api", check: func(context.Context) error { return errors.New("dial tcp dr.example.com:443: i/o timeout") }, optional: true},
+	}, time.Second, 0)
+
+	w := httptest.NewRecorder()
+	readyzHandler(h).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+
+	var body struct {
+		Status   string       `json:"status"`
+		Degraded bool         `json:"degraded"`
+		Checks   []readyCheck `json:"checks"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+
+	expected := []readyCheck{{Name: "ontap-api", Healthy: true}, {Name: "dr-ontap-api", Optional: true}}
+	if body.Status != "ready" || !body.Degraded || !reflect.DeepEqual(body.Checks, expected) {
+		t.Errorf("unexpected readiness %+v", body)
+	}
+
+	if strings.Contains(w.Body.String(), "dr.example.com") {
+		t.Errorf("readiness leaks check errors: %s", w.Body.String())
+	}
+}
+
+func TestHealthCheckerIgnoresCanceledProbes(t *testing.T) {
+	release := make(chan struct{})
+	h := newHealthChecker([]healthCheck{
+		{name: "ontap-api", check: func(ctx context.Context) error {
+			<-release
+			return ctx.Err()
+		}},
+	}, time.Second, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report := h.run(ctx); report.Healthy {
+		t.Errorf("expected no report for a canceled probe, got %+v", report)
+	}
+
+	//the checks keep running on their own context and their report is cached for the next probe
+	close(release)
+	report := h.run(context.Background())
+	if !report.Healthy || len(report.Checks) != 1 {
+		t.Errorf("expected a healthy report, got %+v", report)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// schemaKeywords are the keywords validateJSON enforces, plus annotations that don't constrain anything
+var schemaKeywords = map[string]bool{
+	"type": true, "properties": true, "required": true, "additionalProperties": true, "enum": true, "items": true,
+	"minimum": true, "maximum": true, "minLength": true, "maxLength": true, "pattern": true,
+	"$schema": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true,
+}
+
+var schemaTypes = map[string]bool{"object": true, "array": true, "string": true, "boolean": true, "null": true, "number": true, "integer": true}
+
+// checkSchema returns the problems of a schema validateJSON can't enforce as written: unsupported keywords, unknown types
+// and patterns that don't compile. A schema that passes is enforced completely.
+func checkSchema(schema map[string]interface{}, path string) []string {
+	var problems []string
+
+	keys := make([]string, 0, len(schema))
+	for k := range schema {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !schemaKeywords[k] {
+			problems = append(problems, fmt.Sprintf("%s: unsupported keyword %s", path, k))
+		}
+	}
+
+	types, _ := schema["type"].([]interface{})
+	if name, ok := schema["type"].(string); ok {
+		types = []interface{}{name}
+	}
+	for _, t := range types {
+		if name, ok := t.(string); !ok || !schemaTypes[name] {
+			problems = append(problems, fmt.Sprintf("%s: unknown type %v", path, t))
+		}
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid pattern: %s", path, err))
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			problems = append(problems, checkSchema(property, path+"."+name)...)
+		}
+	}
+
+	for _, k := range []string{"items", "additionalProperties"} {
+		if sub, ok := schema[k].(map[string]interface{}); ok {
+			problems = append(problems, checkSchema(sub, path+"."+k)...)
+		}
+	}
+
+	return problems
+}
+
+// validateJSON checks data against a JSON schema and returns one message per problem, prefixed with the path of the field.
+// Only the keywords in schemaKeywords are supported, checkSchema rejects schemas with others.
+func validateJSON(schema map[string]interface{}, data []byte) []string {
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte("{}")
+	}
+
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return []string{fmt.Sprintf("parameters are not valid JSON: %s", err)}
+	}
+
+	return validateValue(schema, value, "parameters")
+}
+
+func validateValue(schema map[string]interface{}, value interface{}, path string) []string {
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		return []string{fmt.Sprintf("%s: must be of type %s", path, typeNames(t))}
+	}
+
+	var problems []string
+
+	if enum, ok := schema["enum"].([]interface{}); ok && !inEnum(enum, value) {
+		problems = append(problems, fmt.Sprintf("%s: must be one of %s", path, enumNames(enum)))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		problems = append(problems, validateObject(schema, v, path)...)
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				problems = append(problems, validateValue(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case string:
+		if min, ok := number(schema["minLength"]); ok && float64(len([]rune(v))) < min {
+			problems = append(problems, fmt.Sprintf("%s: must be at least %v characters", path, min))
+		}
+		if max, ok := number(schema["maxLength"]); ok && float64(len([]rune(v))) > max {
+			problems = append(problems, fmt.Sprintf("%s: must be at most %v characters", path, max))
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				problems = append(problems, fmt.Sprintf("%s: must match %s", path, pattern))
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if min, ok := number(schema["minimum"]); ok && n < min {
+			problems = append(problems, fmt.Sprintf("%s: must be at least %v", path, min))
+		}
+		if max, ok := number(schema["maximum"]); ok && n > max {
+			problems = append(problems, fmt.Sprintf("%s: must be at most %v", path, max))
+		}
+	}
+
+	return problems
+}
+
+func validateObject(schema map[string]interface{}, object map[string]interface{}, path string) []string {
+	var problems []string
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, present := object[name]; !present {
+					problems = append(problems, fmt.Sprintf("%s.%s: is required", path, name))
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(object))
+	for k := range object {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if property, ok := properties[k].(map[string]interface{}); ok {
+			problems = append(problems, validateValue(property, object[k], path+"."+k)...)
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				problems = append(problems, fmt.Sprintf("%s.%s: unknown parameter", path, k))
+			}
+		case map[string]interface{}:
+			problems = append(problems, validateValue(additional, object[k], path+"."+k)...)
+		}
+	}
+
+	return problems
+}
+
+func matchesType(t interface{}, value interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return matchesTypeName(t, value)
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok && matchesTypeName(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func matchesTypeName(name string, value interface{}) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	}
+
+	return true
+}
+
+func typeNames(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, 0, len(list))
+		for _, name := range list {
+			names = append(names, fmt.Sprint(name))
+		}
+		return strings.Join(names, " or ")
+	}
+
+	return fmt.Sprint(t)
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if n, ok := value.(json.Number); ok {
+			f, _ := n.Float64()
+			if ef, ok := number(e); ok && ef == f {
+				return true
+			}
+			continue
+		}
+
+		if e == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func enumNames(enum []interface{}) string {
+	names := make([]string, 0, len(enum))
+	for _, e := range enum {
+		names = append(names, fmt.Sprint(e))
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// number handles the float64 of schemas decoded without UseNumber as well as json.Number
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidateJSON(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(provisionSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		params   string
+		problems []string
+	}{
+		{``, nil},
+		{`{}`, nil},
+		{`{"size": "10Gi", "autosize": {"mode": "grow", "maximum": "20Gi", "grow_threshold": 90}}`, nil},
+		{`{"size": 10}`, []string{"parameters.size: must be of type string"}},
+		{`{"sise": "10Gi"}`, []string{"parameters.sise: unknown parameter"}},
+		{`{"autosize": {}}`, []string{"parameters.autosize.mode: is required"}},
+		{`{"autosize": {"mode": "shrink"}}`, []string{"parameters.autosize.mode: must be one of grow, grow_shrink, off"}},
+		{`{"autosize": {"mode": "grow", "grow_threshold": 100}}`, []string{"parameters.autosize.grow_threshold: must be at most 99"}},
+		{`{"autosize": {"mode": "grow", "grow_threshold": 1.5}}`, []string{"parameters.autosize.grow_threshold: must be of type integer"}},
+		{`{"b": 1, "a": 2}`, []string{"parameters.a: unknown parameter", "parameters.b: unknown parameter"}},
+		{`[]`, []string{"parameters: must be of type object"}},
+		{`{`, []string{"parameters are not valid JSON: unexpected EOF"}},
+	} {
+		if problems := validateJSON(schema, []byte(tc.params)); !reflect.DeepEqual(problems, tc.problems) {
+			t.Errorf("%s: expected %q, got %q", tc.params, tc.problems, problems)
+		}
+	}
+}
+
+func TestValidateJSONStrings(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":      "string",
+		"minLength": json.Number("2"),
+		"maxLength": float64(4),
+		"pattern":   "^[a-z]+$",
+	}
+
+	for value, problems := range map[string]int{`"ab"`: 0, `"a"`: 1, `"abcde"`: 1, `"A1"`: 1, `"A12345"`: 2} {
+		if got := validateJSON(schema, []byte(value)); len(got) != problems {
+			t.Errorf("%s: expected %d problems, got %q", value, problems, got)
+		}
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	for _, schema := range []string{provisionSchema, updateSchema, bindSchema, qosSchema} {
+		if problems := checkSchema(mustParseSchema(schema), "schema"); problems != nil {
+			t.Errorf("built-in schema: %q", problems)
+		}
+	}
+
+	schema := mustParseSchema(`{
+		"type": "object",
+		"properties": {
+			"size": {"type": "string", "format": "size"},
+			"mode": {"oneOf": [{"const": "a"}, {"const": "b"}]},
+			"path": {"type": "string", "pattern": "^(/"},
+			"tags": {"type": "array", "items": {"type": "text"}}
+		}
+	}`)
+
+	expected := []string{
+		"schema.mode: unsupported keyword oneOf",
+		"schema.path: invalid pattern: error parsing regexp: missing closing ): `^(/`",
+		"schema.size: unsupported keyword format",
+		"schema.tags.items: unknown type text",
+	}
+	if problems := checkSchema(schema, "schema"); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected %q, got %q", expected, problems)
+	}
+}
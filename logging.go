@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi/v7/middlewares"
+)
+
+type logContextKey string
+
+const (
+	requestIdentityKey logContextKey = "request-identity"
+	loggerKey          logContextKey = "logger"
+)
+
+// correlationHeader is sent along with every ontap api request so proxy and api logs can be matched to the broker request
+const correlationHeader = "X-Correlation-ID"
+
+var discardLogger = lager.NewLogger("discard")
+
+// withRequestIdentity puts the X-Broker-API-Request-Identity header in the request context.
+// It also becomes the correlation id when the platform didn't send one of the usual correlation headers.
+func withRequestIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := r.Header.Get("X-Broker-API-Request-Identity")
+		if identity != "" && r.Header.Get(correlationHeader) == "" && r.Header.Get("X-Vcap-Request-Id") == "" {
+			r.Header.Set(correlationHeader, identity)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdentityKey, identity)))
+	})
+}
+
+func requestIdentity(ctx context.Context) string {
+	identity, _ := ctx.Value(requestIdentityKey).(string)
+	return identity
+}
+
+// correlationID returns the id brokerapi assigned to the request
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(middlewares.CorrelationIDKey).(string)
+	return id
+}
+
+func withLogger(ctx context.Context, logger lager.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// loggerFromContext returns the session logger of the request, or a logger that discards everything
+func loggerFromContext(ctx context.Context) lager.Logger {
+	if logger, ok := ctx.Value(loggerKey).(lager.Logger); ok {
+		return logger
+	}
+
+	return discardLogger
+}
+
+// session starts a logger session for a broker operation and attaches it to the context, so the ontap client logs with the same ids
+func (b *broker) session(ctx context.Context, action string, data lager.Data) (context.Context, lager.Logger) {
+	if data == nil {
+		data = lager.Data{}
+	}
+
+	if id := correlationID(ctx); id != "" {
+		data["correlation-id"] = id
+	}
+	if identity := requestIdentity(ctx); identity != "" {
+		data["request-identity"] = identity
+	}
+
+	logger := b.logger.Session(action, data)
+	return withLogger(ctx, logger), logger
+}
+
+// logOutcome logs the result of a broker operation. Deferred after mapFailure it runs first and logs the error before it is mapped to a failure response.
+func logOutcome(logger lager.Logger, err *error) {
+	if *err != nil {
+		logger.Error("failed", *err)
+		return
+	}
+
+	logger.Info("done")
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"crypto/x509"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"code.cloudfoundry.org/lager"
-	"github.com/pivotal-cf/brokerapi/v7"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
 	var logLevels = map[string]lager.LogLevel{
 		"DEBUG": lager.DEBUG,
 		"INFO":  lager.INFO,
@@ -22,33 +28,200 @@ func main() {
 		panic(err)
 	}
 
-	brokerCredentials := brokerapi.BrokerCredentials{
-		Username: config.BrokerUsername,
-		Password: config.BrokerPassword,
+	var forwardedCertCAs *x509.CertPool
+	if config.TrustForwardedClientCert {
+		if forwardedCertCAs, err = clientCAPool(config.TLSClientCA); err != nil {
+			panic(err)
+		}
 	}
+	brokerAuth := newBrokerAuth(config.Users, forwardedCertCAs)
 
-	services, err := CatalogLoad("./catalog.json")
+	catalog, err := CatalogLoad(config.CatalogPath, config.DocsURL, config.MaxVolumeSizeBytes)
 	if err != nil {
 		panic(err)
 	}
 
-	for i := range services {
-		services[i].Metadata.DocumentationUrl = config.DocsURL
-	}
-
 	logger := lager.NewLogger("cf-ontapsmb-broker")
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, logLevels[config.LogLevel]))
 
-	ontapClient, _ := NewOntapClient(config.OntapUser, config.OntapPassword, config.TrustedSSHKey, config.OntapURL, true)
+	hostKeyCallback, err := newHostKeyCallback(logger, config.TrustedSSHKey, config.SSHKnownHostsFile, config.SSHStrictHostKey)
+	if err != nil {
+		panic(err)
+	}
+
+	retryPolicy := RetryPolicy{
+		MaxAttempts: config.OntapRetryAttempts,
+		BaseDelay:   config.OntapRetryBaseDelay,
+		MaxDelay:    config.OntapRetryMaxDelay,
+		OntapCodes:  config.OntapRetryableErrorCodes,
+	}
+
+	ontapClient, err := NewOntapClient(config.OntapUser, config.OntapPassword, config.OntapURL, OntapHTTPOptions{
+		SkipVerify:     config.OntapSkipSSLCheck,
+		CACert:         config.OntapCACert,
+		ClientCert:     config.OntapClientCert,
+		ClientKey:      config.OntapClientKey,
+		MinVersion:     config.OntapTLSMinVersion,
+		ConnectTimeout: config.OntapConnectTimeout,
+		ReadTimeout:    config.OntapReadTimeout,
+	}, OntapSSHOptions{
+		Port:            config.SSHPort,
+		HostKeyCallback: hostKeyCallback,
+		Keepalive:       config.SSHKeepalive,
+		MaxIdle:         config.SSHMaxIdle,
+		CommandTimeout:  config.SSHCommandTimeout,
+	}, retryPolicy)
+	if err != nil {
+		panic(err)
+	}
+
+	if err = ontapClient.DiscoverCapabilities(context.Background(), config.OntapSvmName); err != nil {
+		panic(err)
+	}
+	go ontapClient.RefreshCapabilities(withLogger(ctx, logger.Session("capabilities", lager.Data{"host": ontapClient.URL.Host})), config.CapabilityRefreshInterval, config.OntapSvmName)
 
 	serviceBroker := &broker{
-		services:    services,
+		catalog:     catalog,
 		env:         config,
 		ontapClient: ontapClient,
+		logger:      logger,
+	}
+
+	if err = serviceBroker.checkPlanAggregates(context.Background()); err != nil {
+		panic(err)
+	}
+
+	serviceBroker.audit, err = newAuditLog(config.AuditLog, logger)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceBroker.credentials, err = NewCredentialStore(CredhubOptions{
+		URL:          config.CredhubURL,
+		CACert:       config.CredhubCACert,
+		Client:       config.CredhubClient,
+		ClientSecret: config.CredhubClientSecret,
+		SkipVerify:   config.CredhubSkipSSLCheck,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if config.DrOntapURL != "" {
+		drHostKeyCallback, err := newHostKeyCallback(logger, config.DrTrustedSSHKey, config.DrSSHKnownHostsFile, config.SSHStrictHostKey)
+		if err != nil {
+			panic(err)
+		}
+
+		drClient, err := NewOntapClient(config.DrOntapUser, config.DrOntapPassword, config.DrOntapURL, OntapHTTPOptions{
+			SkipVerify:     config.DrOntapSkipSSLCheck,
+			CACert:         config.DrOntapCACert,
+			MinVersion:     config.OntapTLSMinVersion,
+			ConnectTimeout: config.OntapConnectTimeout,
+			ReadTimeout:    config.OntapReadTimeout,
+		}, OntapSSHOptions{
+			Port:            config.SSHPort,
+			HostKeyCallback: drHostKeyCallback,
+			Keepalive:       config.SSHKeepalive,
+			MaxIdle:         config.SSHMaxIdle,
+			CommandTimeout:  config.SSHCommandTimeout,
+		}, retryPolicy)
+		if err != nil {
+			panic(err)
+		}
+
+		//the DR site is only needed by replicated plans, the refresh below picks it up once it is reachable
+		if err = drClient.DiscoverCapabilities(context.Background(), config.DrSvmName); err != nil {
+			logger.Error("dr-capabilities-failed", err, lager.Data{"host": drClient.URL.Host})
+		}
+		go drClient.RefreshCapabilities(withLogger(ctx, logger.Session("capabilities", lager.Data{"host": drClient.URL.Host})), config.CapabilityRefreshInterval, config.DrSvmName)
+
+		serviceBroker.dr = &site{
+			client:       drClient,
+			svmName:      config.DrSvmName,
+			cifsHostname: config.DrCifsHostname,
+		}
+	}
+
+	health := newHealthChecker(serviceBroker.healthChecks(), config.HealthCheckTimeout, config.HealthCheckCacheTTL)
+	report := health.run(context.Background())
+	if err = report.failures(); err != nil {
+		panic(err)
+	}
+	if report.Degraded {
+		logger.Info("startup-degraded", lager.Data{"checks": report.Checks})
+	}
+
+	//credentials from *_FILE files are rotated by sending SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		current := config
+		for range hup {
+			current = reloadCredentials(logger.Session("reload"), current, brokerAuth, serviceBroker)
+		}
+	}()
+
+	brokerHandler := newBrokerHandler(serviceBroker, logger, brokerAuth.require(roleBroker))
+	inflight := newInflightTracker()
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthzHandler())
+	mux.Handle("/readyz", readyzHandler(health))
+	mux.Handle("/operator/health", brokerAuth.require(roleOperator)(healthReportHandler(health)))
+	mux.Handle("/metrics", brokerAuth.require(roleOperator)(metricsHandler(brokerMetrics, newVolumeUsageCache(ontapClient, config.OntapSvmName, config.VolumeNamePrefix, config.MetricsCacheTTL))))
+	mux.Handle("/operator/failover/", inflight.wrap(brokerAuth.require(roleOperator)(withOriginatingIdentity(failoverHandler(serviceBroker)))))
+	mux.Handle("/", inflight.wrap(withRequestIdentity(withOriginatingIdentity(brokerHandler))))
+
+	//requests get a context that is only cancelled when draining takes too long, so running binds can finish their ssh work
+	requestCtx, abortRequests := context.WithCancel(context.Background())
+	defer abortRequests()
+
+	tlsConfig, err := serverTLSConfig(config.TLSCert, config.TLSKey, config.TLSClientCA)
+	if err != nil {
+		panic(err)
+	}
+
+	server := &http.Server{
+		Addr:        ":" + config.Port,
+		Handler:     mux,
+		TLSConfig:   tlsConfig,
+		BaseContext: func(net.Listener) context.Context { return requestCtx },
+	}
+
+	go func() {
+		logger.Info("starting", lager.Data{"port": config.Port, "tls": tlsConfig != nil})
+
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("listen", err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("shutdown-started", lager.Data{"timeout": config.ShutdownTimeout.String(), "in-flight": inflight.pending()})
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		for _, op := range inflight.pending() {
+			logger.Error("operation-aborted", err, lager.Data{"operation": op})
+		}
+		abortRequests()
+		server.Close()
+	}
+
+	ontapClient.Close()
+	if serviceBroker.dr != nil {
+		serviceBroker.dr.client.Close()
 	}
 
-	brokerHandler := brokerapi.New(serviceBroker, logger, brokerCredentials)
-	fmt.Println("Starting service")
-	http.Handle("/", brokerHandler)
-	http.ListenAndServe(":"+config.Port, nil)
+	logger.Info("shutdown-complete")
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+// semver is the format OSB requires for maintenance_info versions
+var semver = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// checkMaintenanceInfo rejects requests made against another version of the plan than the catalog currently offers
+func (b *broker) checkMaintenanceInfo(planID string, requested *domain.MaintenanceInfo) error {
+	if requested == nil {
+		return nil
+	}
+
+	current := b.catalog.maintenance[planID]
+	if current == nil {
+		if requested.Equals(domain.MaintenanceInfo{}) {
+			return nil
+		}
+		return apiresponses.ErrMaintenanceInfoNilConflict
+	}
+
+	if !current.Equals(*requested) {
+		return apiresponses.ErrMaintenanceInfoConflict
+	}
+
+	return nil
+}
+
+// isUpgrade reports whether cloud controller asks to bring the instance to the maintenance_info of its plan
+func isUpgrade(details domain.UpdateDetails) bool {
+	if details.MaintenanceInfo == nil {
+		return false
+	}
+
+	previous := details.PreviousValues.MaintenanceInfo
+	return previous == nil || !previous.Equals(*details.MaintenanceInfo)
+}
+
+// applyPlanSettings brings the volume and share of the instance in line with the current settings of the plan:
+// QoS and snapshot policy on the volume, the options of the share. A policy group of the instance must exist already, see applyQosPolicy.
+// Returns true once everything matches, an error when the job that sets the policies failed.
+func (b *broker) applyPlanSettings(ctx context.Context, operation, instanceID, planID string) (bool, error) {
+	jobDone, ok, err := b.steps.status(ctx, operation, "plan-settings")
+	if ok && !jobDone {
+		return false, err
+	}
+
+	settings := b.planSettings(planID)
+
+	name := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	id, err := b.ontapClient.GetVolumeIDByName(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	vol, err := b.ontapClient.GetVolumeByID(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	var snapshotPolicy, qosPolicy string
+	if settings.SnapshotPolicy != "" && (vol.SnapshotPolicy == nil || vol.SnapshotPolicy.Name != settings.SnapshotPolicy) {
+		snapshotPolicy = settings.SnapshotPolicy
+	}
+	if vol.Qos == nil || vol.Qos.Policy.Name != settings.qosPolicy(name) {
+		qosPolicy = settings.qosPolicy(name)
+	}
+
+	if snapshotPolicy != "" || qosPolicy != "" {
+		if jobDone {
+			return false, final(fmt.Errorf("Volume %s doesn't have the policies of the plan after the job that set them succeeded", name))
+		}
+
+		jobID, err := b.ontapClient.SetVolumePolicies(ctx, id, snapshotPolicy, qosPolicy)
+		if err == nil {
+			b.steps.track(operation, "plan-settings", b.ontapClient, jobID)
+			auditObject(ctx, "volume", name)
+			auditJob(ctx, jobID)
+		}
+		return false, err
+	}
+
+	svmID, err := b.ontapClient.SvmUUID(ctx, b.env.OntapSvmName)
+	if err != nil {
+		return false, err
+	}
+
+	share, err := b.ontapClient.GetCifsShare(ctx, svmID, name)
+	if err != nil {
+		return false, err
+	}
+
+	if settings.Share.differsFrom(share.cifsShareProperties) {
+		if err = b.ontapClient.SetCifsShareProperties(ctx, svmID, name, settings.Share); err != nil {
+			return false, err
+		}
+		auditObject(ctx, "cifs-share", b.env.OntapSvmName+"/"+name)
+	}
+
+	return true, nil
+}
+
+// differsFrom reports whether an option set in p has another value on the current share
+func (p cifsShareProperties) differsFrom(current cifsShareProperties) bool {
+	for _, o := range []struct{ want, have *bool }{
+		{p.Oplocks, current.Oplocks},
+		{p.AccessBasedEnumeration, current.AccessBasedEnumeration},
+		{p.ChangeNotify, current.ChangeNotify},
+		{p.Encryption, current.Encryption},
+		{p.ShowSnapshot, current.ShowSnapshot},
+		{p.ContinuouslyAvailable, current.ContinuouslyAvailable},
+	} {
+		if o.want != nil && (o.have == nil || *o.have != *o.want) {
+			return true
+		}
+	}
+
+	return false
+}
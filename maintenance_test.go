@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+func TestCheckMaintenanceInfo(t *testing.T) {
+	b := &broker{catalog: brokerCatalog{maintenance: map[string]*domain.MaintenanceInfo{
+		"versioned": {Version: "1.2.0"},
+	}}}
+
+	for _, tc := range []struct {
+		plan      string
+		requested *domain.MaintenanceInfo
+		err       error
+	}{
+		{"versioned", nil, nil},
+		{"versioned", &domain.MaintenanceInfo{Version: "1.2.0"}, nil},
+		{"versioned", &domain.MaintenanceInfo{Version: "1.1.0"}, apiresponses.ErrMaintenanceInfoConflict},
+		{"versioned", &domain.MaintenanceInfo{}, apiresponses.ErrMaintenanceInfoConflict},
+		{"unversioned", nil, nil},
+		{"unversioned", &domain.MaintenanceInfo{}, nil},
+		{"unversioned", &domain.MaintenanceInfo{Version: "1.0.0"}, apiresponses.ErrMaintenanceInfoNilConflict},
+	} {
+		if err := b.checkMaintenanceInfo(tc.plan, tc.requested); err != tc.err {
+			t.Errorf("%s %+v: expected %v, got %v", tc.plan, tc.requested, tc.err, err)
+		}
+	}
+}
+
+func TestIsUpgrade(t *testing.T) {
+	for _, tc := range []struct {
+		previous, requested *domain.MaintenanceInfo
+		upgrade             bool
+	}{
+		{nil, nil, false},
+		{&domain.MaintenanceInfo{Version: "1.0.0"}, nil, false},
+		{nil, &domain.MaintenanceInfo{Version: "1.0.0"}, true},
+		{&domain.MaintenanceInfo{Version: "1.0.0"}, &domain.MaintenanceInfo{Version: "1.0.0"}, false},
+		{&domain.MaintenanceInfo{Version: "1.0.0"}, &domain.MaintenanceInfo{Version: "1.1.0"}, true},
+	} {
+		details := domain.UpdateDetails{MaintenanceInfo: tc.requested, PreviousValues: domain.PreviousValues{MaintenanceInfo: tc.previous}}
+		if upgrade := isUpgrade(details); upgrade != tc.upgrade {
+			t.Errorf("%+v to %+v: expected upgrade %t", tc.previous, tc.requested, tc.upgrade)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "cf_ontapsmb_broker"
+
+type operationStats struct {
+	count       uint64
+	failures    uint64
+	durationSum float64
+}
+
+type ontapErrorKey struct {
+	status int
+	code   string
+}
+
+type metrics struct {
+	mu          sync.Mutex
+	operations  map[string]*operationStats
+	ontapErrors map[ontapErrorKey]uint64
+}
+
+// brokerMetrics collects counters for the broker operations and the ontap api
+var brokerMetrics = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{
+		operations:  make(map[string]*operationStats),
+		ontapErrors: make(map[ontapErrorKey]uint64),
+	}
+}
+
+// observeOperation is meant to be deferred: defer brokerMetrics.observeOperation("bind", time.Now(), &err)
+func (m *metrics) observeOperation(operation string, start time.Time, err *error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.operations[operation]
+	if !ok {
+		stats = &operationStats{}
+		m.operations[operation] = stats
+	}
+
+	stats.count++
+	stats.durationSum += time.Since(start).Seconds()
+	if err != nil && *err != nil {
+		stats.failures++
+	}
+}
+
+func (m *metrics) incOntapError(status int, code string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ontapErrors[ontapErrorKey{status: status, code: code}]++
+}
+
+func (m *metrics) write(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ops := make([]string, 0, len(m.operations))
+	for op := range m.operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	writeHeader(sb, "operations_total", "counter", "Number of broker operations handled")
+	for _, op := range ops {
+		fmt.Fprintf(sb, "%s_operations_total{operation=%q} %d\n", metricsNamespace, op, m.operations[op].count)
+	}
+
+	writeHeader(sb, "operation_failures_total", "counter", "Number of broker operations that returned an error")
+	for _, op := range ops {
+		fmt.Fprintf(sb, "%s_operation_failures_total{operation=%q} %d\n", metricsNamespace, op, m.operations[op].failures)
+	}
+
+	writeHeader(sb, "operation_duration_seconds", "summary", "Time spent handling broker operations")
+	for _, op := range ops {
+		fmt.Fprintf(sb, "%s_operation_duration_seconds_sum{operation=%q} %s\n", metricsNamespace, op, formatFloat(m.operations[op].durationSum))
+		fmt.Fprintf(sb, "%s_operation_duration_seconds_count{operation=%q} %d\n", metricsNamespace, op, m.operations[op].count)
+	}
+
+	keys := make([]ontapErrorKey, 0, len(m.ontapErrors))
+	for k := range m.ontapErrors {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].status != keys[j].status {
+			return keys[i].status < keys[j].status
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	writeHeader(sb, "ontap_api_errors_total", "counter", "Number of failed ontap api requests by status and ontap error code")
+	for _, k := range keys {
+		fmt.Fprintf(sb, "%s_ontap_api_errors_total{status=\"%d\",code=%q} %d\n", metricsNamespace, k.status, k.code, m.ontapErrors[k])
+	}
+}
+
+// volumeUsageCache keeps the last volume listing around so scrapes don't hammer the ontap api
+type volumeUsageCache struct {
+	mu         sync.Mutex
+	client     *OntapClient
+	svmName    string
+	namePrefix string
+	ttl        time.Duration
+	fetched    time.Time
+	volumes    []VolumeUsage
+}
+
+func newVolumeUsageCache(client *OntapClient, svmName, namePrefix string, ttl time.Duration) *volumeUsageCache {
+	return &volumeUsageCache{
+		client:     client,
+		svmName:    svmName,
+		namePrefix: namePrefix,
+		ttl:        ttl,
+	}
+}
+
+func (c *volumeUsageCache) get(ctx context.Context) ([]VolumeUsage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetched.IsZero() && time.Since(c.fetched) < c.ttl {
+		return c.volumes, nil
+	}
+
+	volumes, err := c.client.GetVolumesUsage(ctx, c.svmName, c.namePrefix)
+	if err != nil {
+		return c.volumes, err
+	}
+
+	//the name filter is only a prefix match, other volumes on the svm may start with the prefix too
+	var instances []VolumeUsage
+	for _, v := range volumes {
+		if isInstanceVolumeName(c.namePrefix, v.Name) {
+			instances = append(instances, v)
+		}
+	}
+
+	c.volumes = instances
+	c.fetched = time.Now()
+	return c.volumes, nil
+}
+
+func (c *volumeUsageCache) write(ctx context.Context, sb *strings.Builder) error {
+	volumes, err := c.get(ctx)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(v VolumeUsage) int64
+	}{
+		{"volume_size_bytes", "Size of the volume backing the instance", func(v VolumeUsage) int64 { return v.Space.Size }},
+		{"volume_used_bytes", "Space used on the volume backing the instance", func(v VolumeUsage) int64 { return v.Space.Used }},
+		{"volume_available_bytes", "Space available on the volume backing the instance", func(v VolumeUsage) int64 { return v.Space.Available }},
+		{"volume_inodes_used", "Number of files used on the volume backing the instance", func(v VolumeUsage) int64 { return v.Files.Used }},
+		{"volume_inodes_maximum", "Maximum number of files on the volume backing the instance", func(v VolumeUsage) int64 { return v.Files.Maximum }},
+		{"volume_snapshot_reserve_bytes", "Space reserved for snapshots on the volume backing the instance", func(v VolumeUsage) int64 { return v.Space.Snapshot.ReserveSize }},
+		{"volume_snapshot_reserve_percent", "Percentage of the volume reserved for snapshots", func(v VolumeUsage) int64 { return int64(v.Space.Snapshot.ReservePercent) }},
+	}
+
+	for _, g := range gauges {
+		writeHeader(sb, g.name, "gauge", g.help)
+		for _, v := range volumes {
+			fmt.Fprintf(sb, "%s_%s{instance_id=%q,volume=%q} %d\n", metricsNamespace, g.name, instanceIDFromVolumeName(c.namePrefix, v.Name), v.Name, g.value(v))
+		}
+	}
+
+	return err
+}
+
+func writeHeader(sb *strings.Builder, name, metricType, help string) {
+	fmt.Fprintf(sb, "# HELP %s_%s %s\n", metricsNamespace, name, help)
+	fmt.Fprintf(sb, "# TYPE %s_%s %s\n", metricsNamespace, name, metricType)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// metricsHandler serves the metrics in the prometheus text exposition format
+func metricsHandler(m *metrics, volumes *volumeUsageCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sb strings.Builder
+
+		m.write(&sb)
+
+		scrapeOK := 1
+		if err := volumes.write(r.Context(), &sb); err != nil {
+			scrapeOK = 0
+		}
+		writeHeader(&sb, "volume_scrape_success", "gauge", "Whether the last volume listing from ontap succeeded")
+		fmt.Fprintf(&sb, "%s_volume_scrape_success %d\n", metricsNamespace, scrapeOK)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(sb.String()))
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type OntapVersion struct {
+	Full       string `json:"full"`
+	Generation int    `json:"generation"`
+	Major      int    `json:"major"`
+	Minor      int    `json:"minor"`
+}
+
+// AtLeast compares generation.major, e.g. AtLeast(9, 10)
+func (v OntapVersion) AtLeast(generation, major int) bool {
+	if v.Generation != generation {
+		return v.Generation > generation
+	}
+
+	return v.Major >= major
+}
+
+// ClusterCapabilities is what the broker learned about a cluster at startup. It decides between REST and SSH per feature.
+type ClusterCapabilities struct {
+	Version  OntapVersion
+	SvmUUIDs map[string]string
+	// CIFS local users can be managed through REST since 9.10, before that only through the cli
+	RestCifsLocalUsers bool
+}
+
+type capabilityCache struct {
+	mu   sync.RWMutex
+	caps ClusterCapabilities
+}
+
+func (o *OntapClient) getClusterVersion(ctx context.Context) (OntapVersion, error) {
+	res, err := o.DoApiRequest(ctx, http.MethodGet, "/cluster?fields=version", nil, 200)
+	if err != nil {
+		return OntapVersion{}, err
+	}
+
+	var cluster struct {
+		Version OntapVersion `json:"version"`
+	}
+	err = json.Unmarshal(res.body, &cluster)
+	if err != nil {
+		return OntapVersion{}, fmt.Errorf("Unable to parse result..")
+	}
+
+	return cluster.Version, nil
+}
+
+// DiscoverCapabilities resolves the cluster version and the uuids of the given svms. It fails when one of the svms doesn't exist.
+func (o *OntapClient) DiscoverCapabilities(ctx context.Context, svmNames ...string) error {
+	version, err := o.getClusterVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to get cluster version: %w", err)
+	}
+
+	caps := ClusterCapabilities{
+		Version:            version,
+		SvmUUIDs:           make(map[string]string),
+		RestCifsLocalUsers: version.AtLeast(9, 10),
+	}
+
+	for _, name := range svmNames {
+		uuid, err := o.GetSvmIdByName(ctx, name)
+		if err != nil {
+			return fmt.Errorf("Unable to resolve svm %s: %w", name, err)
+		}
+		caps.SvmUUIDs[name] = uuid
+	}
+
+	o.capabilities.mu.Lock()
+	o.capabilities.caps = caps
+	o.capabilities.mu.Unlock()
+
+	return nil
+}
+
+// RefreshCapabilities rediscovers the capabilities every interval until ctx is done. Failures keep the previous capabilities.
+func (o *OntapClient) RefreshCapabilities(ctx context.Context, interval time.Duration, svmNames ...string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := o.DiscoverCapabilities(ctx, svmNames...); err != nil {
+				loggerFromContext(ctx).Error("refresh-capabilities-failed", err, lager.Data{"host": o.URL.Host})
+			}
+		}
+	}
+}
+
+func (o *OntapClient) Capabilities() ClusterCapabilities {
+	o.capabilities.mu.RLock()
+	defer o.capabilities.mu.RUnlock()
+
+	return o.capabilities.caps
+}
+
+// SvmUUID returns the cached uuid of the svm, looking it up if it wasn't discovered
+func (o *OntapClient) SvmUUID(ctx context.Context, name string) (string, error) {
+	o.capabilities.mu.RLock()
+	uuid, ok := o.capabilities.caps.SvmUUIDs[name]
+	o.capabilities.mu.RUnlock()
+	if ok {
+		return uuid, nil
+	}
+
+	uuid, err := o.GetSvmIdByName(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	o.capabilities.mu.Lock()
+	if o.capabilities.caps.SvmUUIDs == nil {
+		o.capabilities.caps.SvmUUIDs = make(map[string]string)
+	}
+	o.capabilities.caps.SvmUUIDs[name] = uuid
+	o.capabilities.mu.Unlock()
+
+	return uuid, nil
+}
+
+func (o *OntapClient) CifsServerEnabled(ctx context.Context, svmName string) (bool, error) {
+	services, err := ListRecords[struct {
+		Enabled bool `json:"enabled"`
+	}](ctx, o, "/protocols/cifs/services", ListQuery{
+		Fields:  []string{"enabled"},
+		Filters: map[string]string{"svm.name": svmName},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return len(services) == 1 && services[0].Enabled, nil
+}
+
+// CheckSSH runs a harmless command, which also verifies the host key
+func (o *OntapClient) CheckSSH(ctx context.Context) error {
+	_, err := o.runCommand(ctx, SSHCommand{Cmd: "version"})
+	return err
+}
+
+type cifsLocalUser struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name,omitempty"`
+	Password string `json:"password,omitempty"`
+	SID      string `json:"sid,omitempty"`
+	Svm      struct {
+		UUID string `json:"uuid"`
+	} `json:"svm"`
+}
+
+func (o *OntapClient) createCifsUserREST(ctx context.Context, svmUUID, username, password, fullName string) error {
+	user := cifsLocalUser{
+		Name:     username,
+		FullName: fullName,
+		Password: password,
+	}
+	user.Svm.UUID = svmUUID
+
+	bdy, _ := json.Marshal(user)
+	_, err := o.DoApiRequest(ctx, http.MethodPost, "/protocols/cifs/local-users", bdy, 201)
+	return err
+}
+
+func (o *OntapClient) findCifsUserREST(ctx context.Context, svmUUID string, filters map[string]string) (*cifsLocalUser, error) {
+	filters["svm.uuid"] = svmUUID
+	users, err := ListRecords[cifsLocalUser](ctx, o, "/protocols/cifs/local-users", ListQuery{
+		Fields:  []string{"name", "full_name", "sid"},
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("No cifs user matching %v: %w", filters, ErrNotFound)
+	}
+
+	return &users[0], nil
+}
+
+// usernameWithoutDomain strips the cifs server name ontap puts in front of local user names
+func usernameWithoutDomain(name string) string {
+	if i := strings.LastIndex(name, "\\"); i >= 0 {
+		return name[i+1:]
+	}
+
+	return name
+}
+
+// deleteCifsUserREST deletes the local user with exactly this name. The api only knows the name with the cifs server in front,
+// so the wildcard query can return other users ending in the same name and the match is checked here.
+func (o *OntapClient) deleteCifsUserREST(ctx context.Context, svmUUID, username string) error {
+	users, err := ListRecords[cifsLocalUser](ctx, o, "/protocols/cifs/local-users", ListQuery{
+		Fields:  []string{"name", "sid"},
+		Filters: map[string]string{"svm.uuid": svmUUID, "name": "*" + username},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if usernameWithoutDomain(user.Name) == username {
+			_, err = o.DoApiRequest(ctx, http.MethodDelete, fmt.Sprintf("/protocols/cifs/local-users/%s/%s", svmUUID, user.SID), nil, 200)
+			return err
+		}
+	}
+
+	return fmt.Errorf("No cifs user with name %s: %w", username, ErrNotFound)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDeleteCifsUserRESTExactName(t *testing.T) {
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted, r.URL.Path)
+			return
+		}
+
+		//the wildcard query also matches users that end in the same name
+		fmt.Fprint(w, `{"records":[{"name":"CIFS1\\xuser1","sid":"S-1-5-21-1"},{"name":"CIFS1\\user1","sid":"S-1-5-21-2"}],"num_records":2}`)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/api")
+	client := &OntapClient{URL: *u, httpClient: *server.Client()}
+
+	if err := client.deleteCifsUserREST(context.Background(), "svm-uuid", "user1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deleted) != 1 || !strings.HasSuffix(deleted[0], "/protocols/cifs/local-users/svm-uuid/S-1-5-21-2") {
+		t.Errorf("unexpected deletes %v", deleted)
+	}
+
+	if err := client.deleteCifsUserREST(context.Background(), "svm-uuid", "ser1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
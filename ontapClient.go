@@ -2,24 +2,34 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/crypto/ssh"
+	"code.cloudfoundry.org/lager"
 )
 
 type OntapClient struct {
-	username      string
-	password      string
-	URL           url.URL
-	httpClient    http.Client
-	trustedSSHKey string
+	credMu         sync.RWMutex
+	username       string
+	password       string
+	URL            url.URL
+	httpClient     http.Client
+	cli            CommandRunner
+	commandTimeout time.Duration
+	retry          RetryPolicy
+	capabilities   capabilityCache
+	certAuth       bool //authenticate to the api with the client certificate instead of basic auth. SSH still uses the password
 }
 
 type OntapErrBody struct {
@@ -47,7 +57,78 @@ type OntapResponse struct {
 	statusCode int
 }
 
-func NewOntapClient(username, password, trustedSSHKey, urlString string, skipssl bool) (*OntapClient, error) {
+// OntapHTTPOptions configures how the client talks to the ontap api. CACert, ClientCert and ClientKey take either PEM data or a path to a PEM file.
+type OntapHTTPOptions struct {
+	SkipVerify     bool
+	CACert         string
+	ClientCert     string
+	ClientKey      string
+	MinVersion     string
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration //time to wait for the response headers after sending a request
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func readPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+
+	return ioutil.ReadFile(value)
+}
+
+func (t OntapHTTPOptions) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: t.SkipVerify}
+
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Invalid minimum TLS version %s. Allowed versions: 1.0, 1.1, 1.2, 1.3", t.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+
+	if t.CACert != "" {
+		pem, err := readPEM(t.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA certificate: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No valid certificates found in CA certificate")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if t.ClientCert != "" || t.ClientKey != "" {
+		certPEM, err := readPEM(t.ClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading client certificate: %s", err)
+		}
+
+		keyPEM, err := readPEM(t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading client key: %s", err)
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+func NewOntapClient(username, password, urlString string, httpOptions OntapHTTPOptions, sshOptions OntapSSHOptions, retry RetryPolicy) (*OntapClient, error) {
 	urlParsed, err := url.Parse(urlString)
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing storageGrid URL: %v", err.Error())
@@ -57,42 +138,82 @@ func NewOntapClient(username, password, trustedSSHKey, urlString string, skipssl
 		urlParsed.Path = "/api"
 	}
 
+	tlsConfig, err := httpOptions.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: skipssl},
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: httpOptions.ConnectTimeout}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   httpOptions.ConnectTimeout,
+		ResponseHeaderTimeout: httpOptions.ReadTimeout,
 	}
 
 	httpClient := http.Client{Transport: tr}
 
 	return &OntapClient{
-		username:      username,
-		password:      password,
-		URL:           *urlParsed,
-		httpClient:    httpClient,
-		trustedSSHKey: trustedSSHKey,
+		username:       username,
+		password:       password,
+		URL:            *urlParsed,
+		httpClient:     httpClient,
+		cli:            newSSHRunner(urlParsed.Hostname(), username, password, sshOptions),
+		commandTimeout: sshOptions.CommandTimeout,
+		retry:          retry,
+		certAuth:       len(tlsConfig.Certificates) > 0,
 	}, nil
 }
 
-func (o *OntapClient) DoApiRequest(method, path string, body []byte, checkForCode int) (OntapResponse, error) {
+// DoApiRequest sends the request, retrying transient failures according to the retry policy
+func (o *OntapClient) DoApiRequest(ctx context.Context, method, path string, body []byte, checkForCode int) (OntapResponse, error) {
+	options := retryOptionsFromContext(ctx, o.retry)
+
+	for attempt := 1; ; attempt++ {
+		res, err := o.doApiRequestOnce(ctx, method, path, body, checkForCode)
+		if err == nil || attempt >= options.attempts || !o.retry.retryable(method, err, options.ontapCodes) {
+			return res, err
+		}
+
+		delay := options.delay(o.retry, attempt)
+		loggerFromContext(ctx).Info("ontap-api-retry", lager.Data{"method": method, "path": path, "attempt": attempt, "attempts": options.attempts, "error": err.Error(), "delay": delay.String()})
+		if serr := sleepContext(ctx, delay); serr != nil {
+			return res, err
+		}
+	}
+}
+
+func (o *OntapClient) doApiRequestOnce(ctx context.Context, method, path string, body []byte, checkForCode int) (OntapResponse, error) {
 	var apiResp OntapResponse
 
-	req, err := http.NewRequest(method, fmt.Sprintf("%s/%s", o.URL.String(), path), bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/%s", o.URL.String(), path), bytes.NewReader(body))
 	if err != nil {
 		return OntapResponse{}, fmt.Errorf("Error creating request: %s", err)
 	}
 
 	req.Header.Add("Content-Type", "application/json")
-	req.SetBasicAuth(o.username, o.password)
+	if id := correlationID(ctx); id != "" {
+		req.Header.Set(correlationHeader, id)
+	}
+	if !o.certAuth {
+		o.credMu.RLock()
+		req.SetBasicAuth(o.username, o.password)
+		o.credMu.RUnlock()
+	}
 
+	start := time.Now()
 	resp, err := o.httpClient.Do(req)
 	if err != nil {
-		return apiResp, fmt.Errorf("Error doing http request: %s", err)
+		return apiResp, fmt.Errorf("Error doing http request: %w", err)
 	}
 
 	defer resp.Body.Close()
+	loggerFromContext(ctx).Debug("ontap-api-request", lager.Data{"method": method, "path": path, "status": resp.StatusCode, "duration": time.Since(start).String()})
 
 	if resp.StatusCode != checkForCode {
 		var eRes OntapErrResponse
 		json.NewDecoder(resp.Body).Decode(&eRes)
+		brokerMetrics.incOntapError(resp.StatusCode, eRes.Error.Code)
 		return apiResp, OntapError{
 			err:        eRes.Error.Message,
 			body:       eRes,
@@ -107,45 +228,84 @@ func (o *OntapClient) DoApiRequest(method, path string, body []byte, checkForCod
 	return apiResp, nil
 }
 
-func (o *OntapClient) GetVolumeIDByName(name string) (string, error) {
-	res, err := o.DoApiRequest(http.MethodGet, fmt.Sprintf("/storage/volumes?name=%s", name), nil, 200)
+func (o *OntapClient) GetVolumeIDByName(ctx context.Context, name string) (string, error) {
+	records, err := ListRecords[Record](ctx, o, "/storage/volumes", ListQuery{
+		Filters: map[string]string{"name": name},
+	})
 	if err != nil {
 		return "", err
 	}
 
-	var list ResultList
-	err = json.Unmarshal(res.body, &list)
+	if len(records) == 0 {
+		return "", fmt.Errorf("No volume with name %s: %w", name, ErrNotFound)
+	}
+
+	if len(records) != 1 {
+		return "", fmt.Errorf("Didn't find the expected (1) number of records for volumes with name %s: %w", name, ErrDuplicate)
+	}
+
+	return records[0].UUID, nil
+}
+
+// SvmAggregates returns the aggregates the svm may create volumes on. An empty list means no restriction.
+func (o *OntapClient) SvmAggregates(ctx context.Context, svmName string) ([]string, error) {
+	records, err := ListRecords[struct {
+		Aggregates []Aggregate `json:"aggregates"`
+	}](ctx, o, "/svm/svms", ListQuery{
+		Fields:  []string{"aggregates"},
+		Filters: map[string]string{"name": svmName},
+	})
 	if err != nil {
-		return "", fmt.Errorf("Unable to parse result..")
+		return nil, err
+	}
+
+	if len(records) != 1 {
+		return nil, fmt.Errorf("No svm with name %s: %w", svmName, ErrNotFound)
 	}
 
-	if list.NumRecords != 1 {
-		return "", fmt.Errorf("Didn't find the expected (1) number of records for volumes with name %s", name)
+	var names []string
+	for _, a := range records[0].Aggregates {
+		names = append(names, a.Name)
 	}
 
-	return list.Records[0].UUID, nil
+	return names, nil
 }
 
-func (o *OntapClient) GetSvmIdByName(name string) (string, error) {
-	res, err := o.DoApiRequest(http.MethodGet, fmt.Sprintf("/svm/svms?name=%s", name), nil, 200)
+// AggregateNames returns the names of the aggregates of the cluster
+func (o *OntapClient) AggregateNames(ctx context.Context) ([]string, error) {
+	records, err := ListRecords[Record](ctx, o, "/storage/aggregates", ListQuery{Fields: []string{"name"}})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	var names []string
+	for _, r := range records {
+		names = append(names, r.Name)
 	}
 
-	var list ResultList
-	err = json.Unmarshal(res.body, &list)
+	return names, nil
+}
+
+func (o *OntapClient) GetSvmIdByName(ctx context.Context, name string) (string, error) {
+	records, err := ListRecords[Record](ctx, o, "/svm/svms", ListQuery{
+		Filters: map[string]string{"name": name},
+	})
 	if err != nil {
-		return "", fmt.Errorf("Unable to parse result..")
+		return "", err
 	}
 
-	if list.NumRecords != 1 {
-		return "", fmt.Errorf("Didn't find the expected (1) number of records for volumes with name %s", name)
+	if len(records) == 0 {
+		return "", fmt.Errorf("No svm with name %s: %w", name, ErrNotFound)
 	}
 
-	return list.Records[0].UUID, nil
+	if len(records) != 1 {
+		return "", fmt.Errorf("Didn't find the expected (1) number of records for svms with name %s: %w", name, ErrDuplicate)
+	}
+
+	return records[0].UUID, nil
 }
 
-func (o *OntapClient) CreateVolume(name, svmName, aggName, comment, exportPolicy string, size int64) (string, error) {
+func (o *OntapClient) CreateVolume(ctx context.Context, name, svmName, aggName, comment, exportPolicy string, size int64) (string, error) {
 	v := Volume{}
 	v.Name = name
 	v.Comment = comment
@@ -155,7 +315,7 @@ func (o *OntapClient) CreateVolume(name, svmName, aggName, comment, exportPolicy
 	v.Nas.ExportPolicy.Name = exportPolicy
 
 	bdy, _ := json.Marshal(v)
-	res, err := o.DoApiRequest(http.MethodPost, "/storage/volumes", bdy, 202)
+	res, err := o.DoApiRequest(ctx, http.MethodPost, "/storage/volumes", bdy, 202)
 	if err != nil {
 		return "", err
 	}
@@ -169,7 +329,7 @@ func (o *OntapClient) CreateVolume(name, svmName, aggName, comment, exportPolicy
 	return ar.Job.UUID, nil
 }
 
-func (o *OntapClient) CreateCifsVolume(name, svmName string, size int64) (string, error) {
+func (o *OntapClient) CreateCifsVolume(ctx context.Context, name, svmName, storageService string, size int64) (string, error) {
 	v := CifsApplication{}
 	v.Name = name
 	v.SmartContainer = true
@@ -193,12 +353,197 @@ func (o *OntapClient) CreateCifsVolume(name, svmName string, size int64) (string
 		StorageService: struct {
 			Name string "json:\"name\""
 		}{
-			Name: "value",
+			Name: storageService,
 		},
 	})
 
 	bdy, _ := json.Marshal(v)
-	res, err := o.DoApiRequest(http.MethodPost, "/application/applications", bdy, 202)
+	res, err := o.DoApiRequest(ctx, http.MethodPost, "/application/applications", bdy, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+// CreateNasVolume creates a volume for a share without the application api, which can neither encrypt nor place a volume on an aggregate.
+// The storage service is applied through its adaptive QoS policy. An empty aggregate leaves the placement to ontap.
+// The share has to be created once the job is done.
+func (o *OntapClient) CreateNasVolume(ctx context.Context, name, svmName, storageService, aggregate string, encrypted bool, size int64) (string, error) {
+	volume := map[string]interface{}{
+		"name":       name,
+		"svm":        map[string]string{"name": svmName},
+		"size":       size,
+		"encryption": map[string]bool{"enabled": encrypted},
+		"nas":        map[string]string{"path": "/" + name, "security_style": "ntfs"},
+		"qos":        map[string]interface{}{"policy": PolicyRef{Name: storageService}},
+		"tiering":    map[string]string{"policy": "none"},
+	}
+	if aggregate != "" {
+		volume["aggregates"] = []Aggregate{{Name: aggregate}}
+	}
+
+	bdy, _ := json.Marshal(volume)
+
+	res, err := o.DoApiRequest(ctx, http.MethodPost, "/storage/volumes", bdy, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+func (o *OntapClient) GetJobStatus(ctx context.Context, uuid string) (OntapResponse, error) {
+	return o.DoApiRequest(ctx, http.MethodGet, fmt.Sprintf("/cluster/jobs/%s", uuid), nil, 200)
+}
+
+func (o *OntapClient) DeleteVolume(ctx context.Context, uuid string) (string, error) {
+	res, err := o.DoApiRequest(ctx, http.MethodDelete, fmt.Sprintf("/storage/volumes/%s", uuid), nil, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+func (o *OntapClient) SetVolumeAutosize(ctx context.Context, uuid string, autosize VolumeAutosize) (string, error) {
+	bdy, _ := json.Marshal(struct {
+		Autosize VolumeAutosize `json:"autosize"`
+	}{autosize})
+
+	res, err := o.DoApiRequest(ctx, http.MethodPatch, fmt.Sprintf("/storage/volumes/%s", uuid), bdy, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+// SetVolumeComment replaces the comment of the volume
+func (o *OntapClient) SetVolumeComment(ctx context.Context, uuid, comment string) (string, error) {
+	bdy, _ := json.Marshal(map[string]string{"comment": comment})
+
+	res, err := o.DoApiRequest(ctx, http.MethodPatch, fmt.Sprintf("/storage/volumes/%s", uuid), bdy, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+func (o *OntapClient) EnableVolumeEncryption(ctx context.Context, uuid string) (string, error) {
+	bdy, _ := json.Marshal(map[string]interface{}{
+		"encryption": map[string]bool{"enabled": true},
+	})
+
+	res, err := o.DoApiRequest(ctx, http.MethodPatch, fmt.Sprintf("/storage/volumes/%s", uuid), bdy, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+// SetVolumePolicies assigns the snapshot and QoS policy to the volume. Empty names are left alone.
+func (o *OntapClient) SetVolumePolicies(ctx context.Context, uuid, snapshotPolicy, qosPolicy string) (string, error) {
+	body := make(map[string]interface{})
+	if snapshotPolicy != "" {
+		body["snapshot_policy"] = PolicyRef{Name: snapshotPolicy}
+	}
+	if qosPolicy != "" {
+		body["qos"] = map[string]interface{}{"policy": PolicyRef{Name: qosPolicy}}
+	}
+
+	bdy, _ := json.Marshal(body)
+	res, err := o.DoApiRequest(ctx, http.MethodPatch, fmt.Sprintf("/storage/volumes/%s", uuid), bdy, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+// MoveVolume starts a non-disruptive move of the volume. The job finishes early, the progress of the move is in the movement of the volume.
+func (o *OntapClient) MoveVolume(ctx context.Context, uuid, aggregate string) (string, error) {
+	bdy, _ := json.Marshal(map[string]interface{}{
+		"movement": map[string]interface{}{"destination_aggregate": Aggregate{Name: aggregate}},
+	})
+
+	res, err := o.DoApiRequest(ctx, http.MethodPatch, fmt.Sprintf("/storage/volumes/%s", uuid), bdy, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+func (o *OntapClient) GetQosPolicy(ctx context.Context, svmName, name string) (QosPolicy, error) {
+	records, err := ListRecords[QosPolicy](ctx, o, "/storage/qos/policies", ListQuery{
+		Fields:  []string{"fixed", "adaptive"},
+		Filters: map[string]string{"svm.name": svmName, "name": name},
+	})
+	if err != nil {
+		return QosPolicy{}, err
+	}
+
+	if len(records) == 0 {
+		return QosPolicy{}, fmt.Errorf("No QoS policy with name %s: %w", name, ErrNotFound)
+	}
+
+	return records[0], nil
+}
+
+func (o *OntapClient) CreateQosPolicy(ctx context.Context, policy QosPolicy) (string, error) {
+	bdy, _ := json.Marshal(policy)
+	res, err := o.DoApiRequest(ctx, http.MethodPost, "/storage/qos/policies", bdy, 202)
 	if err != nil {
 		return "", err
 	}
@@ -212,12 +557,29 @@ func (o *OntapClient) CreateCifsVolume(name, svmName string, size int64) (string
 	return ar.Job.UUID, nil
 }
 
-func (o *OntapClient) GetJobStatus(uuid string) (OntapResponse, error) {
-	return o.DoApiRequest(http.MethodGet, fmt.Sprintf("/cluster/jobs/%s", uuid), nil, 200)
+// UpdateQosPolicy sets the limits of the policy. Name and svm can't be changed.
+func (o *OntapClient) UpdateQosPolicy(ctx context.Context, uuid string, fixed *QosFixed, adaptive *QosAdaptive) (string, error) {
+	bdy, _ := json.Marshal(struct {
+		Fixed    *QosFixed    `json:"fixed,omitempty"`
+		Adaptive *QosAdaptive `json:"adaptive,omitempty"`
+	}{fixed, adaptive})
+
+	res, err := o.DoApiRequest(ctx, http.MethodPatch, fmt.Sprintf("/storage/qos/policies/%s", uuid), bdy, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
 }
 
-func (o *OntapClient) DeleteVolume(uuid string) (string, error) {
-	res, err := o.DoApiRequest(http.MethodDelete, fmt.Sprintf("/storage/volumes/%s", uuid), nil, 202)
+func (o *OntapClient) DeleteQosPolicy(ctx context.Context, uuid string) (string, error) {
+	res, err := o.DoApiRequest(ctx, http.MethodDelete, fmt.Sprintf("/storage/qos/policies/%s", uuid), nil, 202)
 	if err != nil {
 		return "", err
 	}
@@ -231,8 +593,18 @@ func (o *OntapClient) DeleteVolume(uuid string) (string, error) {
 	return ar.Job.UUID, nil
 }
 
-func (o *OntapClient) GetVolumeByID(uuid string) (Volume, error) {
-	res, err := o.DoApiRequest(http.MethodGet, fmt.Sprintf("/storage/volumes/%s?fields=nas.path", uuid), nil, 200)
+// KeyManagerConfigured reports whether an onboard or external key manager is set up. Without one volumes can't be encrypted.
+func (o *OntapClient) KeyManagerConfigured(ctx context.Context) (bool, error) {
+	records, err := ListRecords[Record](ctx, o, "/security/key-managers", ListQuery{MaxRecords: 1})
+	if err != nil {
+		return false, err
+	}
+
+	return len(records) > 0, nil
+}
+
+func (o *OntapClient) GetVolumeByID(ctx context.Context, uuid string) (Volume, error) {
+	res, err := o.DoApiRequest(ctx, http.MethodGet, fmt.Sprintf("/storage/volumes/%s?fields=comment,nas.path,size,autosize,encryption,snapshot_policy,qos.policy,aggregates,movement", uuid), nil, 200)
 	if err != nil {
 		return Volume{}, err
 	}
@@ -246,102 +618,319 @@ func (o *OntapClient) GetVolumeByID(uuid string) (Volume, error) {
 	return vol, nil
 }
 
-func (o *OntapClient) StartSSHSession() (*ssh.Client, *ssh.Session, error) {
-	sshConfig := &ssh.ClientConfig{
-		User: o.username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(o.password),
+func (o *OntapClient) GetVolumesUsage(ctx context.Context, svmName, namePrefix string) ([]VolumeUsage, error) {
+	return ListRecords[VolumeUsage](ctx, o, "/storage/volumes", ListQuery{
+		Fields: []string{"space.size", "space.used", "space.available", "space.snapshot.reserve_percent", "space.snapshot.reserve_size", "files.used", "files.maximum"},
+		Filters: map[string]string{
+			"svm.name": svmName,
+			"name":     namePrefix + "*",
 		},
-		HostKeyCallback: trustedHostKeyCallback(o.trustedSSHKey),
-		Timeout:         15 * time.Second,
+	})
+}
+
+// WaitForJob polls the job until it leaves the running state or the context is done
+func (o *OntapClient) WaitForJob(ctx context.Context, uuid string) error {
+	for {
+		res, err := o.GetJobStatus(ctx, uuid)
+		if err != nil {
+			return err
+		}
+
+		var jobStatus JobStatus
+		err = json.Unmarshal(res.body, &jobStatus)
+		if err != nil {
+			return fmt.Errorf("Error parsing job status for job %s", uuid)
+		}
+
+		switch jobStatus.State {
+		case "success":
+			return nil
+		case "failure":
+			return fmt.Errorf("Job %s failed: %s", uuid, jobStatus.Message)
+		}
+
+		if err = sleepContext(ctx, 2*time.Second); err != nil {
+			return fmt.Errorf("Stopped waiting for job %s: %s", uuid, err)
+		}
 	}
+}
 
-	connection, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", o.URL.Hostname(), "22"), sshConfig)
+func (o *OntapClient) MountVolume(ctx context.Context, uuid, junctionPath string) (string, error) {
+	bdy, _ := json.Marshal(map[string]interface{}{
+		"nas": map[string]string{"path": junctionPath},
+	})
+
+	res, err := o.DoApiRequest(ctx, http.MethodPatch, fmt.Sprintf("/storage/volumes/%s", uuid), bdy, 202)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to dial: %s", err)
+		return "", err
 	}
 
-	session, err := connection.NewSession()
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to create session: %s", err)
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+// CreateCifsShare creates a share that denies guests like the shares of the application api. Users get access when they are bound.
+func (o *OntapClient) CreateCifsShare(ctx context.Context, svmName, name, path string) error {
+	share := struct {
+		cifsShare
+		Acls []cifsACL `json:"acls"`
+	}{
+		Acls: []cifsACL{{UserOrGroup: "BUILTIN\\Guests", Type: "windows", Permission: "no_access"}},
 	}
+	share.Name = name
+	share.Path = path
+	share.Svm.Name = svmName
 
-	return connection, session, nil
+	bdy, _ := json.Marshal(share)
+	_, err := o.DoApiRequest(ctx, http.MethodPost, "/protocols/cifs/shares", bdy, 201)
+	return err
 }
 
-func (o *OntapClient) CreateCifsUser(username, password, fullName string) error {
-	connection, session, err := o.StartSSHSession()
+func (o *OntapClient) GetCifsShare(ctx context.Context, svmId, name string) (cifsShare, error) {
+	res, err := o.DoApiRequest(ctx, http.MethodGet, fmt.Sprintf("/protocols/cifs/shares/%s/%s?fields=*", svmId, name), nil, 200)
 	if err != nil {
-		return err
+		return cifsShare{}, err
 	}
-	defer connection.Close()
-	defer session.Close()
 
-	stdin, err := session.StdinPipe()
+	var share cifsShare
+	if err = json.Unmarshal(res.body, &share); err != nil {
+		return cifsShare{}, fmt.Errorf("Error parsing cifs share response json")
+	}
+
+	return share, nil
+}
+
+func (o *OntapClient) SetCifsShareProperties(ctx context.Context, svmId, name string, properties cifsShareProperties) error {
+	bdy, _ := json.Marshal(properties)
+	_, err := o.DoApiRequest(ctx, http.MethodPatch, fmt.Sprintf("/protocols/cifs/shares/%s/%s", svmId, name), bdy, 200)
+	return err
+}
+
+// CreateSnapmirrorRelationship must be called on the destination cluster. The destination volume is created and the relationship initialized by ontap.
+func (o *OntapClient) CreateSnapmirrorRelationship(ctx context.Context, sourcePath, destinationPath, policy, schedule string) (string, error) {
+	bdy, _ := json.Marshal(map[string]interface{}{
+		"source":             SnapmirrorEndpoint{Path: sourcePath},
+		"destination":        SnapmirrorEndpoint{Path: destinationPath},
+		"create_destination": map[string]bool{"enabled": true},
+		"policy":             map[string]string{"name": policy},
+		"transfer_schedule":  map[string]string{"name": schedule},
+		"state":              "snapmirrored",
+	})
+
+	res, err := o.DoApiRequest(ctx, http.MethodPost, "/snapmirror/relationships", bdy, 202)
+	if err != nil {
+		return "", err
+	}
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
 	if err != nil {
-		return fmt.Errorf("%s", err.Error())
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
 	}
 
-	var b bytes.Buffer
-	session.Stdout = &b
-	session.Stderr = &b
+	return ar.Job.UUID, nil
+}
+
+// GetSnapmirrorRelationship returns nil if there is no relationship for the destination path
+func (o *OntapClient) GetSnapmirrorRelationship(ctx context.Context, destinationPath string) (*SnapmirrorRelationship, error) {
+	records, err := ListRecords[SnapmirrorRelationship](ctx, o, "/snapmirror/relationships", ListQuery{
+		Fields:  []string{"source.path", "destination.path", "state", "healthy", "lag_time", "transfer.state", "unhealthy_reason"},
+		Filters: map[string]string{"destination.path": destinationPath},
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	cmd := fmt.Sprintf("vserver cifs users-and-groups local-user create -user-name %s -full-name %s", username, fullName)
-	session.Start(cmd)
-	time.Sleep(250 * time.Millisecond)
-	fmt.Fprintf(stdin, "%s\n", password)
-	time.Sleep(250 * time.Millisecond)
-	fmt.Fprintf(stdin, "%s\n", password)
-	time.Sleep(10 * time.Millisecond)
-	fmt.Fprintf(stdin, "%s\n", "exit")
-	session.Wait()
+	if len(records) == 0 {
+		return nil, nil
+	}
 
-	return nil
+	return &records[0], nil
 }
 
-func (o *OntapClient) GetCifsUserByFullname(svmName, fullName string) (string, error) {
-	var username string
+func (o *OntapClient) BreakSnapmirrorRelationship(ctx context.Context, uuid string) (string, error) {
+	bdy, _ := json.Marshal(map[string]string{"state": "broken_off"})
+	res, err := o.DoApiRequest(ctx, http.MethodPatch, fmt.Sprintf("/snapmirror/relationships/%s", uuid), bdy, 202)
+	if err != nil {
+		return "", err
+	}
 
-	connection, session, err := o.StartSSHSession()
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+func (o *OntapClient) DeleteSnapmirrorRelationship(ctx context.Context, uuid string) (string, error) {
+	res, err := o.DoApiRequest(ctx, http.MethodDelete, fmt.Sprintf("/snapmirror/relationships/%s", uuid), nil, 202)
 	if err != nil {
 		return "", err
 	}
-	defer connection.Close()
-	defer session.Close()
+
+	var ar AcceptResponse
+	err = json.Unmarshal(res.body, &ar)
+	if err != nil {
+		return "", fmt.Errorf("Did not get expected response body. Got instead: %s", string(res.body))
+	}
+
+	return ar.Job.UUID, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetCredentials replaces the credentials used for the api and the cli
+func (o *OntapClient) SetCredentials(username, password string) {
+	o.credMu.Lock()
+	o.username = username
+	o.password = password
+	o.credMu.Unlock()
+
+	o.cli.SetCredentials(username, password)
+}
+
+// Close releases the pooled ssh connections
+func (o *OntapClient) Close() error {
+	o.httpClient.CloseIdleConnections()
+	return o.cli.Close()
+}
+
+// runCommand runs a cli command with the configured timeout, or less if the context has an earlier deadline
+func (o *OntapClient) runCommand(ctx context.Context, command SSHCommand) (SSHResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, o.commandTimeout)
+	defer cancel()
+
+	return o.cli.Run(ctx, command)
+}
+
+func (o *OntapClient) CreateCifsUser(ctx context.Context, svmName, username, password, fullName string) error {
+	if o.Capabilities().RestCifsLocalUsers {
+		svmUUID, err := o.SvmUUID(ctx, svmName)
+		if err != nil {
+			return err
+		}
+
+		return o.createCifsUserREST(ctx, svmUUID, username, password, fullName)
+	}
+
+	return o.createCifsUserSSH(ctx, username, password, fullName)
+}
+
+func (o *OntapClient) createCifsUserSSH(ctx context.Context, username, password, fullName string) error {
+	cmd := fmt.Sprintf("vserver cifs users-and-groups local-user create -user-name %s -full-name %s", username, fullName)
+	_, err := o.runCommand(ctx, SSHCommand{
+		Cmd:   cmd,
+		Input: []string{password, password, "exit"},
+	})
+
+	//the exit status of the interactive create is not reliable, a failed create shows up when assigning the user
+	var ce *CommandError
+	if errors.As(err, &ce) {
+		return nil
+	}
+
+	return err
+}
+
+func (o *OntapClient) GetCifsUserByFullname(ctx context.Context, svmName, fullName string) (string, error) {
+	if o.Capabilities().RestCifsLocalUsers {
+		svmUUID, err := o.SvmUUID(ctx, svmName)
+		if err != nil {
+			return "", err
+		}
+
+		user, err := o.findCifsUserREST(ctx, svmUUID, map[string]string{"full_name": fullName})
+		if err != nil {
+			return "", err
+		}
+
+		return usernameWithoutDomain(user.Name), nil
+	}
+
+	return o.getCifsUserByFullnameSSH(ctx, svmName, fullName)
+}
+
+func (o *OntapClient) getCifsUserByFullnameSSH(ctx context.Context, svmName, fullName string) (string, error) {
+	var username string
 
 	cmd := fmt.Sprintf("vserver cifs users-and-groups local-user show -fields user-name -full-name %s", fullName)
-	out, err := session.CombinedOutput(cmd)
+	res, err := o.runCommand(ctx, SSHCommand{Cmd: cmd})
 	if err != nil {
 		return "", err
 	}
 
-	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+	out := res.Stdout + res.Stderr
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
 		if strings.HasPrefix(line, svmName) {
-			username = strings.TrimSpace(strings.TrimLeft(line, svmName))
+			username = strings.TrimSpace(strings.TrimPrefix(line, svmName))
 		}
 	}
 
+	//the show command doesn't always exit non-zero when nothing matches
+	if username == "" {
+		return "", fmt.Errorf("No cifs user with full name %s: %w", fullName, ErrNotFound)
+	}
+
 	return username, nil
 }
 
-func (o *OntapClient) DeleteCifsUser(username string) error {
-	connection, session, err := o.StartSSHSession()
-	if err != nil {
-		return err
+func (o *OntapClient) DeleteCifsUser(ctx context.Context, svmName, username string) error {
+	if o.Capabilities().RestCifsLocalUsers {
+		svmUUID, err := o.SvmUUID(ctx, svmName)
+		if err != nil {
+			return err
+		}
+
+		return o.deleteCifsUserREST(ctx, svmUUID, username)
 	}
-	defer connection.Close()
-	defer session.Close()
 
+	return o.deleteCifsUserSSH(ctx, username)
+}
+
+func (o *OntapClient) deleteCifsUserSSH(ctx context.Context, username string) error {
 	cmd := fmt.Sprintf("vserver cifs users-and-groups local-user delete -user-name %s", username)
-	err = session.Run(cmd)
+	_, err := o.runCommand(ctx, SSHCommand{Cmd: cmd})
+	return err
+}
+
+// CifsShareUsers returns the names of the local users with full control of the share. Builtin groups and Everyone are left out.
+func (o *OntapClient) CifsShareUsers(ctx context.Context, svmId, shareName string) ([]string, error) {
+	acls, err := ListRecords[cifsACL](ctx, o, fmt.Sprintf("/protocols/cifs/shares/%s/%s/acls", svmId, shareName), ListQuery{
+		Fields: []string{"user_or_group", "type", "permission"},
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var users []string
+	for _, acl := range acls {
+		if acl.Type != "windows" || acl.Permission != "full_control" || acl.UserOrGroup == "Everyone" || strings.HasPrefix(acl.UserOrGroup, "BUILTIN\\") {
+			continue
+		}
+		users = append(users, usernameWithoutDomain(acl.UserOrGroup))
 	}
 
-	return nil
+	return users, nil
 }
 
-func (o *OntapClient) AssignCifsUser(username, svmId, shareName string) error {
+func (o *OntapClient) AssignCifsUser(ctx context.Context, username, svmId, shareName string) error {
 	acl := cifsACL{
 		UserOrGroup: username,
 		Type:        "windows",
@@ -350,26 +939,8 @@ func (o *OntapClient) AssignCifsUser(username, svmId, shareName string) error {
 
 	bdy, _ := json.Marshal(acl)
 
-	tries := 3
-	var err error
-
-	for tries > 0 {
-		err = nil
-		_, err = o.DoApiRequest(http.MethodPost, fmt.Sprintf("/protocols/cifs/shares/%s/%s/acls", svmId, shareName), bdy, 201)
-		if err == nil {
-			return nil
-		}
-
-		if ace, ok := err.(OntapError); ok {
-			if ace.body.Error.Code != "4" {
-				return err
-			}
-			tries--
-			time.Sleep(5 * time.Second)
-		} else {
-			return err
-		}
-	}
-
+	//a freshly created user is not always known to the cifs server yet, ontap answers with code 4 until it is. This can take 10 seconds or more
+	ctx = withRetryOptions(ctx, 5, 3*time.Second, ontapCodeEntryDoesntExist)
+	_, err := o.DoApiRequest(ctx, http.MethodPost, fmt.Sprintf("/protocols/cifs/shares/%s/%s/acls", svmId, shareName), bdy, 201)
 	return err
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListQuery selects the records and fields of a collection request. Filters use the ontap query syntax, e.g. {"name": "A*"}
+type ListQuery struct {
+	Fields     []string
+	Filters    map[string]string
+	MaxRecords int //page size, ontap's default is used when 0. ListRecords returns at most this many records
+}
+
+func (q ListQuery) encode() string {
+	values := url.Values{}
+	for k, v := range q.Filters {
+		values.Set(k, v)
+	}
+
+	if len(q.Fields) > 0 {
+		values.Set("fields", strings.Join(q.Fields, ","))
+	}
+
+	if q.MaxRecords > 0 {
+		values.Set("max_records", strconv.Itoa(q.MaxRecords))
+	}
+
+	return values.Encode()
+}
+
+type listPage[T any] struct {
+	Records    []T `json:"records"`
+	NumRecords int `json:"num_records"`
+	Links      struct {
+		Next *struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"_links"`
+}
+
+// EachRecord calls fn for every record of the collection, following _links.next until the last page. Returning an error from fn stops the iteration.
+func EachRecord[T any](ctx context.Context, o *OntapClient, path string, query ListQuery, fn func(T) error) error {
+	next := path
+	if q := query.encode(); q != "" {
+		next = fmt.Sprintf("%s?%s", path, q)
+	}
+
+	for next != "" {
+		res, err := o.DoApiRequest(ctx, http.MethodGet, next, nil, 200)
+		if err != nil {
+			return err
+		}
+
+		var page listPage[T]
+		err = json.Unmarshal(res.body, &page)
+		if err != nil {
+			return fmt.Errorf("Unable to parse result..")
+		}
+
+		for _, record := range page.Records {
+			if err = fn(record); err != nil {
+				return err
+			}
+		}
+
+		next = ""
+		if page.Links.Next != nil {
+			//next links include the /api prefix which DoApiRequest adds itself
+			next = strings.TrimPrefix(page.Links.Next.Href, o.URL.Path)
+		}
+	}
+
+	return nil
+}
+
+// errEnoughRecords stops EachRecord once ListRecords has MaxRecords records
+var errEnoughRecords = errors.New("enough records")
+
+// ListRecords returns all records of the collection, or the first MaxRecords when it is set
+func ListRecords[T any](ctx context.Context, o *OntapClient, path string, query ListQuery) ([]T, error) {
+	var records []T
+	err := EachRecord(ctx, o, path, query, func(record T) error {
+		records = append(records, record)
+		if query.MaxRecords > 0 && len(records) >= query.MaxRecords {
+			return errEnoughRecords
+		}
+		return nil
+	})
+
+	if err == errEnoughRecords {
+		err = nil
+	}
+
+	return records, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// pagedServer serves /api/things as pages of one record each
+func pagedServer(t *testing.T, total int, requests *int) *OntapClient {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+
+		var page int
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+
+		next := ""
+		if page+1 < total {
+			next = fmt.Sprintf(`,"_links":{"next":{"href":"/api/things?page=%d"}}`, page+1)
+		}
+		fmt.Fprintf(w, `{"records":[{"uuid":"uuid-%d"}],"num_records":1%s}`, page, next)
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL + "/api")
+	return &OntapClient{URL: *u, httpClient: *server.Client()}
+}
+
+func TestListRecordsFollowsNext(t *testing.T) {
+	var requests int
+	client := pagedServer(t, 3, &requests)
+
+	records, err := ListRecords[Record](context.Background(), client, "/things", ListQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 3 || records[2].UUID != "uuid-2" || requests != 3 {
+		t.Errorf("expected 3 records in 3 requests, got %+v in %d", records, requests)
+	}
+}
+
+func TestListRecordsStopsAtMaxRecords(t *testing.T) {
+	var requests int
+	client := pagedServer(t, 3, &requests)
+
+	records, err := ListRecords[Record](context.Background(), client, "/things", ListQuery{MaxRecords: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || requests != 1 {
+		t.Errorf("expected 1 record in 1 request, got %+v in %d", records, requests)
+	}
+}
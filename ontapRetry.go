@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy decides which failed ontap api requests are retried and how long to wait in between
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	OntapCodes  []string //ontap error codes that are always retryable
+}
+
+type retryOptions struct {
+	attempts   int
+	minDelay   time.Duration
+	ontapCodes []string
+}
+
+type retryOptionsKey struct{}
+
+// withRetryOptions overrides the number of attempts for the requests done with ctx, sets a lower bound for the delay between them
+// and adds ontap error codes that are retryable for this operation only
+func withRetryOptions(ctx context.Context, attempts int, minDelay time.Duration, ontapCodes ...string) context.Context {
+	return context.WithValue(ctx, retryOptionsKey{}, retryOptions{attempts: attempts, minDelay: minDelay, ontapCodes: ontapCodes})
+}
+
+func retryOptionsFromContext(ctx context.Context, policy RetryPolicy) retryOptions {
+	options := retryOptions{attempts: policy.MaxAttempts}
+	if o, ok := ctx.Value(retryOptionsKey{}).(retryOptions); ok {
+		options = o
+	}
+
+	options.ontapCodes = append(options.ontapCodes, policy.OntapCodes...)
+	if options.attempts < 1 {
+		options.attempts = 1
+	}
+
+	return options
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodPatch:
+		return true
+	}
+
+	return false
+}
+
+// retryable classifies an error. 429 and 503 mean the request was not processed so any method can be retried.
+// For 502 and connection errors we can't tell if ontap acted on it, so those are only retried for idempotent methods.
+func (p RetryPolicy) retryable(method string, err error, ontapCodes []string) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var oe OntapError
+	if errors.As(err, &oe) {
+		for _, code := range ontapCodes {
+			if oe.body.Error.Code == code {
+				return true
+			}
+		}
+
+		switch oe.statusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return idempotent(method)
+		}
+
+		return false
+	}
+
+	if !idempotent(method) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// delay is the backoff of the policy, but at least the minimum delay of the operation
+func (o retryOptions) delay(p RetryPolicy, attempt int) time.Duration {
+	if delay := p.backoff(attempt); delay > o.minDelay {
+		return delay
+	}
+
+	return o.minDelay
+}
+
+// backoff returns an exponential delay with full jitter for the given (1 based) attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)))
+}
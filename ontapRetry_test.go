@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func ontapError(statusCode int, code string) OntapError {
+	return OntapError{statusCode: statusCode, body: OntapErrResponse{Error: OntapErrBody{Code: code}}}
+}
+
+func TestRetryable(t *testing.T) {
+	policy := RetryPolicy{}
+
+	for _, tc := range []struct {
+		name      string
+		method    string
+		err       error
+		codes     []string
+		retryable bool
+	}{
+		{"503 post", http.MethodPost, ontapError(http.StatusServiceUnavailable, ""), nil, true},
+		{"429 post", http.MethodPost, ontapError(http.StatusTooManyRequests, ""), nil, true},
+		{"502 get", http.MethodGet, ontapError(http.StatusBadGateway, ""), nil, true},
+		{"502 post", http.MethodPost, ontapError(http.StatusBadGateway, ""), nil, false},
+		{"400", http.MethodGet, ontapError(http.StatusBadRequest, "262179"), nil, false},
+		{"retryable code", http.MethodPost, ontapError(http.StatusBadRequest, "4"), []string{"4"}, true},
+		{"connection reset get", http.MethodGet, fmt.Errorf("Error doing http request: %w", syscall.ECONNRESET), nil, true},
+		{"connection reset post", http.MethodPost, fmt.Errorf("Error doing http request: %w", syscall.ECONNRESET), nil, false},
+		{"eof patch", http.MethodPatch, fmt.Errorf("Error doing http request: %w", io.EOF), nil, true},
+		{"canceled", http.MethodGet, fmt.Errorf("Error doing http request: %w", context.Canceled), nil, false},
+	} {
+		if got := policy.retryable(tc.method, tc.err, tc.codes); got != tc.retryable {
+			t.Errorf("%s: expected %t, got %t", tc.name, tc.retryable, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	for attempt, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		for i := 0; i < 100; i++ {
+			if delay := policy.backoff(attempt); delay < 0 || delay >= max {
+				t.Fatalf("attempt %d: delay %s not in [0, %s)", attempt, delay, max)
+			}
+		}
+	}
+
+	if delay := (RetryPolicy{}).backoff(3); delay != 0 {
+		t.Errorf("expected no delay without a base delay, got %s", delay)
+	}
+}
+
+func TestRetryOptions(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, OntapCodes: []string{"13303812"}}
+
+	options := retryOptionsFromContext(context.Background(), policy)
+	if options.attempts != 3 || len(options.ontapCodes) != 1 {
+		t.Errorf("unexpected defaults %+v", options)
+	}
+
+	options = retryOptionsFromContext(withRetryOptions(context.Background(), 5, 3*time.Second, "4"), policy)
+	if options.attempts != 5 || len(options.ontapCodes) != 2 {
+		t.Errorf("unexpected overrides %+v", options)
+	}
+
+	if delay := options.delay(policy, 1); delay != 3*time.Second {
+		t.Errorf("expected the minimum delay, got %s", delay)
+	}
+}
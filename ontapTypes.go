@@ -11,12 +11,69 @@ type Aggregate struct {
 	UUID string `json:"uuid,omitempty"`
 }
 
+// PolicyRef references a named ontap policy, e.g. a snapshot or QoS policy
+type PolicyRef struct {
+	Name string `json:"name,omitempty"`
+	UUID string `json:"uuid,omitempty"`
+}
+
+type VolumeAutosize struct {
+	Mode          string `json:"mode,omitempty"`
+	Maximum       int64  `json:"maximum,omitempty"`
+	GrowThreshold int    `json:"grow_threshold,omitempty"`
+}
+
+// QosFixed limits the throughput of the volumes in a policy group to fixed values
+type QosFixed struct {
+	MaxThroughputIOPS int64 `json:"max_throughput_iops,omitempty"`
+	MaxThroughputMBPS int64 `json:"max_throughput_mbps,omitempty"`
+	MinThroughputIOPS int64 `json:"min_throughput_iops,omitempty"`
+	MinThroughputMBPS int64 `json:"min_throughput_mbps,omitempty"`
+}
+
+// QosAdaptive scales the throughput limits with the size of the volume, in IOPS per TB
+type QosAdaptive struct {
+	ExpectedIOPS    int64 `json:"expected_iops,omitempty"`
+	PeakIOPS        int64 `json:"peak_iops,omitempty"`
+	AbsoluteMinIOPS int64 `json:"absolute_min_iops,omitempty"`
+}
+
+type QosPolicy struct {
+	UUID string `json:"uuid,omitempty"`
+	Name string `json:"name"`
+	Svm  struct {
+		Name string `json:"name,omitempty"`
+	} `json:"svm"`
+	Fixed    *QosFixed    `json:"fixed,omitempty"`
+	Adaptive *QosAdaptive `json:"adaptive,omitempty"`
+}
+
+// VolumeMovement is the state of the last (or running) move of a volume to another aggregate
+type VolumeMovement struct {
+	State                string    `json:"state,omitempty"`
+	PercentComplete      int       `json:"percent_complete,omitempty"`
+	DestinationAggregate Aggregate `json:"destination_aggregate"`
+}
+
 type Volume struct {
-	Aggregates []Aggregate `json:"aggregates"`
-	Comment    string      `json:"comment"`
-	Name       string      `json:"name"`
-	Size       int64       `json:"size"`
-	Svm        struct {
+	Aggregates []Aggregate     `json:"aggregates"`
+	Comment    string          `json:"comment"`
+	Name       string          `json:"name"`
+	Size       int64           `json:"size"`
+	Autosize   *VolumeAutosize `json:"autosize,omitempty"`
+	Encryption *struct {
+		Enabled bool   `json:"enabled"`
+		State   string `json:"state,omitempty"`
+		Status  *struct {
+			Message string `json:"message"`
+		} `json:"status,omitempty"`
+	} `json:"encryption,omitempty"`
+	SnapshotPolicy *PolicyRef      `json:"snapshot_policy,omitempty"`
+	Movement       *VolumeMovement `json:"movement,omitempty"`
+	Qos            *struct {
+		Policy PolicyRef `json:"policy"`
+	} `json:"qos,omitempty"`
+	Svm struct {
 		UUID string `json:"uuid,omitempty"`
 		Name string `json:"name,omitempty"`
 	} `json:"svm"`
@@ -101,12 +158,10 @@ var statusMap = map[string]domain.LastOperationState{
 	"failure": domain.Failed,
 }
 
-type ResultList struct {
-	Records []struct {
-		UUID string `json:"uuid"`
-		Name string `json:"name"`
-	} `json:"records"`
-	NumRecords int `json:"num_records"`
+// Record is the minimal representation of a collection member
+type Record struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
 }
 
 type cifsACL struct {
@@ -114,3 +169,59 @@ type cifsACL struct {
 	Type        string `json:"type"`
 	Permission  string `json:"permission"`
 }
+
+type VolumeUsage struct {
+	UUID  string `json:"uuid"`
+	Name  string `json:"name"`
+	Space struct {
+		Size      int64 `json:"size"`
+		Used      int64 `json:"used"`
+		Available int64 `json:"available"`
+		Snapshot  struct {
+			ReservePercent int   `json:"reserve_percent"`
+			ReserveSize    int64 `json:"reserve_size"`
+		} `json:"snapshot"`
+	} `json:"space"`
+	Files struct {
+		Used    int64 `json:"used"`
+		Maximum int64 `json:"maximum"`
+	} `json:"files"`
+}
+
+type SnapmirrorEndpoint struct {
+	Path string `json:"path"`
+}
+
+type SnapmirrorRelationship struct {
+	UUID        string             `json:"uuid,omitempty"`
+	Source      SnapmirrorEndpoint `json:"source"`
+	Destination SnapmirrorEndpoint `json:"destination"`
+	State       string             `json:"state,omitempty"`
+	Healthy     bool               `json:"healthy"`
+	LagTime     string             `json:"lag_time,omitempty"`
+	Transfer    *struct {
+		State string `json:"state"`
+	} `json:"transfer,omitempty"`
+	UnhealthyReason []struct {
+		Message string `json:"message"`
+	} `json:"unhealthy_reason,omitempty"`
+}
+
+type cifsShare struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Svm  struct {
+		Name string `json:"name"`
+	} `json:"svm"`
+	cifsShareProperties
+}
+
+// cifsShareProperties are the share options a plan can set. Unset options keep the ontap default.
+type cifsShareProperties struct {
+	Oplocks                *bool `json:"oplocks,omitempty"`
+	AccessBasedEnumeration *bool `json:"access_based_enumeration,omitempty"`
+	ChangeNotify           *bool `json:"change_notify,omitempty"`
+	Encryption             *bool `json:"encryption,omitempty"`
+	ShowSnapshot           *bool `json:"show_snapshot,omitempty"`
+	ContinuouslyAvailable  *bool `json:"continuously_available,omitempty"`
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// operationData is handed to the cloud controller as the operation of an async request and comes back on every LastOperation poll.
+// Besides the ontap job it carries the work that can only be done once the job has finished.
+type operationData struct {
+	JobID     string          `json:"job_id"`
+	Autosize  *VolumeAutosize `json:"autosize,omitempty"`
+	Encrypt   bool            `json:"encrypt,omitempty"`
+	Share     bool            `json:"share,omitempty"`
+	Replicate bool            `json:"replicate,omitempty"`
+	Teardown  bool            `json:"teardown,omitempty"`
+	Qos       *QosPolicy      `json:"qos,omitempty"`
+	// QosOverride are the qos values the user asked for, kept on the volume for later upgrades and plan changes
+	QosOverride *QosParameters `json:"qos_override,omitempty"`
+	RemoveQos   bool           `json:"remove_qos,omitempty"`
+	// PlanSettings is the plan whose settings are applied to the volume and share once the job is done
+	PlanSettings string `json:"plan_settings,omitempty"`
+}
+
+func (o operationData) encode() string {
+	bytes, _ := json.Marshal(o)
+	return string(bytes)
+}
+
+func decodeOperationData(data string) operationData {
+	var o operationData
+	if err := json.Unmarshal([]byte(data), &o); err != nil || o.JobID == "" {
+		//operations started by older broker versions only contain the job uuid
+		return operationData{JobID: data}
+	}
+
+	return o
+}
+
+// followUp is work of an operation that LastOperation does once the job of the operation succeeded.
+// apply returns true when the work is done, otherwise a description of its progress.
+type followUp struct {
+	when   bool
+	event  string
+	action string
+	apply  func(ctx context.Context) (bool, string, error)
+}
+
+// followUps returns the work the operation still needs, in the order it has to be done
+func (b *broker) followUps(op operationData, instanceID string) []followUp {
+	aggregate := b.planSettings(op.PlanSettings).Aggregate
+
+	steps := []followUp{
+		{op.Share, "share-create", "Creating share", func(ctx context.Context) (bool, string, error) {
+			done, err := b.applyShare(ctx, instanceID)
+			return done, "Creating share", err
+		}},
+		{op.Autosize != nil, "autosize", "Setting autosize", func(ctx context.Context) (bool, string, error) {
+			done, err := b.applyAutosize(ctx, op.JobID, instanceID, *op.Autosize)
+			return done, "Configuring volume autosize", err
+		}},
+		{op.Encrypt, "encryption", "Enabling encryption", func(ctx context.Context) (bool, string, error) {
+			done, err := b.applyEncryption(ctx, op.JobID, instanceID)
+			return done, "Encrypting volume", err
+		}},
+		{op.PlanSettings != "" && aggregate != "", "volume-move", "Moving volume", func(ctx context.Context) (bool, string, error) {
+			done, percent, err := b.applyVolumeMove(ctx, instanceID, aggregate)
+			return done, fmt.Sprintf("Moving volume to aggregate %s (%d%%)", aggregate, percent), err
+		}},
+		{op.Qos != nil, "qos-policy", "Configuring QoS policy", func(ctx context.Context) (bool, string, error) {
+			done, err := b.applyQosPolicy(ctx, op.JobID, *op.Qos)
+			return done, "Configuring QoS policy", err
+		}},
+		{op.QosOverride != nil, "qos-override", "Recording QoS parameters", func(ctx context.Context) (bool, string, error) {
+			done, err := b.recordQosOverride(ctx, op.JobID, instanceID, *op.QosOverride)
+			return done, "Recording QoS parameters", err
+		}},
+		{op.PlanSettings != "", "plan-settings", "Applying plan settings", func(ctx context.Context) (bool, string, error) {
+			done, err := b.applyPlanSettings(ctx, op.JobID, instanceID, op.PlanSettings)
+			return done, "Applying plan settings", err
+		}},
+		{op.Replicate, "replication", "Setting up replication", func(ctx context.Context) (bool, string, error) {
+			done, err := b.ensureReplication(ctx, op.JobID, instanceID)
+			return done, "Initializing SnapMirror replication", err
+		}},
+		{op.Teardown && b.dr != nil, "teardown", "Deleting volumes", func(ctx context.Context) (bool, string, error) {
+			done, err := b.teardownVolumes(ctx, op.JobID, instanceID)
+			return done, "Deleting source and DR volumes", err
+		}},
+		//the policy group of the instance can only go once no volume uses it
+		{op.RemoveQos, "qos-policy-delete", "Deleting QoS policy", func(ctx context.Context) (bool, string, error) {
+			done, err := b.removeQosPolicy(ctx, op.JobID, instanceID)
+			return done, "Deleting QoS policy", err
+		}},
+	}
+
+	var needed []followUp
+	for _, step := range steps {
+		if step.when {
+			needed = append(needed, step)
+		}
+	}
+
+	return needed
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+type operatorResponse struct {
+	InstanceID  string `json:"instance_id"`
+	Description string `json:"description"`
+	Error       string `json:"error,omitempty"`
+}
+
+// failoverHandler handles POST /operator/failover/{instance_id}
+func failoverHandler(b *broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		instanceID := strings.TrimPrefix(r.URL.Path, "/operator/failover/")
+		if instanceID == "" || strings.Contains(instanceID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		resp := operatorResponse{InstanceID: instanceID}
+		status := http.StatusOK
+
+		if b.dr == nil {
+			status = http.StatusBadRequest
+			resp.Error = "No DR destination configured"
+		} else if err := b.Failover(r.Context(), instanceID); err != nil {
+			status = http.StatusInternalServerError
+			resp.Error = err.Error()
+		} else {
+			resp.Description = "Mirror broken and share available on " + b.dr.cifsHostname + ". Existing bindings lost access, rebind and restage their apps to use the DR site."
+		}
+
+		writeJSON(w, status, resp)
+	})
+}
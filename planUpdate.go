@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// volumeMoveRunning are the movement states of a volume move that hasn't finished yet
+var volumeMoveRunning = map[string]bool{
+	"queued":          true,
+	"replicating":     true,
+	"paused":          true,
+	"cutover_wait":    true,
+	"cutover_pending": true,
+	"cutover":         true,
+}
+
+func onAggregate(vol Volume, aggregate string) bool {
+	for _, a := range vol.Aggregates {
+		if a.Name == aggregate {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPlanAggregates returns an error when a plan places volumes on an aggregate the cluster doesn't have or the svm may not use.
+// It runs at startup, the catalog itself doesn't know the cluster.
+func (b *broker) checkPlanAggregates(ctx context.Context) error {
+	var planned []string
+	for _, settings := range b.catalog.plans {
+		if settings.Aggregate != "" && !contains(planned, settings.Aggregate) {
+			planned = append(planned, settings.Aggregate)
+		}
+	}
+	sort.Strings(planned)
+	if len(planned) == 0 {
+		return nil
+	}
+
+	existing, err := b.ontapClient.AggregateNames(ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to list aggregates: %w", err)
+	}
+
+	allowed, err := b.ontapClient.SvmAggregates(ctx, b.env.OntapSvmName)
+	if err != nil {
+		return fmt.Errorf("Unable to get the aggregates of svm %s: %w", b.env.OntapSvmName, err)
+	}
+
+	var problems []string
+	for _, aggregate := range planned {
+		if !contains(existing, aggregate) {
+			problems = append(problems, fmt.Sprintf("aggregate %s doesn't exist", aggregate))
+		} else if len(allowed) > 0 && !contains(allowed, aggregate) {
+			problems = append(problems, fmt.Sprintf("aggregate %s is not assigned to svm %s", aggregate, b.env.OntapSvmName))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid plan aggregates: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// planQos computes the policy group of the instance for the plan, keeping the qos values the user asked for where the plan allows them
+func (b *broker) planQos(planID, volumeName string, vol Volume) *QosPolicy {
+	qos, err := b.desiredQos(planID, volumeName, currentQosOverride(vol))
+	if err != nil {
+		//the values don't fit the plan, back to its defaults
+		qos, _ = b.desiredQos(planID, volumeName, nil)
+	}
+
+	return qos
+}
+
+// checkPlanChange returns an error when the volume can't be changed from one plan to the other
+func (b *broker) checkPlanChange(ctx context.Context, previousPlanID, planID string, vol Volume) error {
+	previous, next := b.planSettings(previousPlanID), b.planSettings(planID)
+
+	if previous.Replicated != next.Replicated {
+		return fmt.Errorf("Changing between replicated and non-replicated plans is not supported")
+	}
+
+	if previous.Encrypted && !next.Encrypted {
+		return fmt.Errorf("An encrypted volume can't be changed to a plan without encryption")
+	}
+
+	if next.Encrypted && !previous.Encrypted {
+		configured, err := b.ontapClient.KeyManagerConfigured(ctx)
+		if err != nil {
+			return fmt.Errorf("KeyManagerConfigured failed: %w", err)
+		}
+
+		if !configured {
+			return fmt.Errorf("Plan requires encryption but no key manager is configured on the cluster")
+		}
+	}
+
+	return b.checkVolumeSize(planID, vol.Size)
+}
+
+// startPlanSettings starts bringing the volume to the settings of the plan: a move when the volume is not on the aggregate of the plan,
+// else the policy group of the instance when it needs one and doesn't match, the policies otherwise.
+// LastOperation finishes the job with applyVolumeMove, applyQosPolicy and applyPlanSettings.
+func (b *broker) startPlanSettings(ctx context.Context, id, name string, vol Volume, planID string, qos *QosPolicy) (string, error) {
+	settings := b.planSettings(planID)
+	if settings.Aggregate != "" && !onAggregate(vol, settings.Aggregate) {
+		return b.ontapClient.MoveVolume(ctx, id, settings.Aggregate)
+	}
+
+	if qos != nil {
+		jobID, err := b.syncQosPolicy(ctx, *qos)
+		if err != nil || jobID != "" {
+			return jobID, err
+		}
+	}
+
+	return b.ontapClient.SetVolumePolicies(ctx, id, settings.SnapshotPolicy, settings.qosPolicy(name))
+}
+
+// applyVolumeMove moves the instance's volume to the aggregate unless it is already there or on its way.
+// Returns true once the volume is on the aggregate, otherwise the progress of the move in percent.
+func (b *broker) applyVolumeMove(ctx context.Context, instanceID, aggregate string) (bool, int, error) {
+	name := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	id, err := b.ontapClient.GetVolumeIDByName(ctx, name)
+	if err != nil {
+		return false, 0, err
+	}
+
+	vol, err := b.ontapClient.GetVolumeByID(ctx, id)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if onAggregate(vol, aggregate) {
+		return true, 100, nil
+	}
+
+	if m := vol.Movement; m != nil && m.DestinationAggregate.Name == aggregate {
+		switch {
+		case volumeMoveRunning[m.State], m.State == "success":
+			return false, m.PercentComplete, nil
+		case m.State == "failed" || m.State == "aborted":
+			return false, m.PercentComplete, final(fmt.Errorf("Moving volume %s to aggregate %s %s", name, aggregate, m.State))
+		}
+	}
+
+	jobID, err := b.ontapClient.MoveVolume(ctx, id, aggregate)
+	if err == nil {
+		auditObject(ctx, "volume", name)
+		auditJob(ctx, jobID)
+	}
+	return false, 0, err
+}
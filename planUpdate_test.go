@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckPlanAggregates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/storage/aggregates"):
+			fmt.Fprint(w, `{"records":[{"name":"aggr1"},{"name":"aggr2"}],"num_records":2}`)
+		case strings.HasSuffix(r.URL.Path, "/svm/svms"):
+			fmt.Fprint(w, `{"records":[{"aggregates":[{"name":"aggr1"}]}],"num_records":1}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/api")
+	client := &OntapClient{URL: *u, httpClient: *server.Client()}
+
+	for _, tc := range []struct {
+		aggregates []string
+		err        string
+	}{
+		{nil, ""},
+		{[]string{"aggr1", "aggr1"}, ""},
+		{[]string{"aggr2"}, "Invalid plan aggregates: aggregate aggr2 is not assigned to svm svm1"},
+		{[]string{"aggr1", "aggr3"}, "Invalid plan aggregates: aggregate aggr3 doesn't exist"},
+	} {
+		plans := map[string]planSettings{"other": {}}
+		for i, a := range tc.aggregates {
+			plans[fmt.Sprint(i)] = planSettings{Aggregate: a}
+		}
+
+		b := &broker{env: brokerConfig{OntapSvmName: "svm1"}, ontapClient: client, catalog: brokerCatalog{plans: plans}}
+
+		err := b.checkPlanAggregates(context.Background())
+		if (err == nil && tc.err != "") || (err != nil && err.Error() != tc.err) {
+			t.Errorf("%v: expected %q, got %v", tc.aggregates, tc.err, err)
+		}
+	}
+}
+
+func TestPlanQosAfterUpgrade(t *testing.T) {
+	b := &broker{env: brokerConfig{OntapSvmName: "svm1"}, catalog: brokerCatalog{plans: map[string]planSettings{
+		"limited": {Qos: &planQos{Fixed: &QosFixed{MaxThroughputIOPS: 1000}, Limits: &QosFixed{MaxThroughputIOPS: 5000}}},
+	}}}
+
+	requested := b.qosOverride("limited", &QosParameters{MaxIOPS: 3000})
+	if requested == nil || requested.MaxIOPS != 3000 {
+		t.Fatalf("expected an override of 3000 iops, got %+v", requested)
+	}
+	if same := b.qosOverride("limited", &QosParameters{MaxIOPS: 1000}); same != nil {
+		t.Errorf("expected values equal to the plan to be no override, got %+v", same)
+	}
+
+	//the new catalog version raises the default of the plan
+	b.catalog.plans["limited"] = planSettings{Qos: &planQos{Fixed: &QosFixed{MaxThroughputIOPS: 2000}, Limits: &QosFixed{MaxThroughputIOPS: 5000}}}
+
+	for _, tc := range []struct {
+		comment string
+		iops    int64
+	}{
+		{"", 2000},
+		{"created by hand", 2000},
+		{volumeComment{Qos: requested}.encode(), 3000},
+		{volumeComment{Qos: &QosParameters{MaxIOPS: 9000}}.encode(), 2000},
+	} {
+		qos := b.planQos("limited", "A_vol", Volume{Comment: tc.comment})
+		if qos == nil || qos.Fixed.MaxThroughputIOPS != tc.iops {
+			t.Errorf("%q: expected %d iops, got %+v", tc.comment, tc.iops, qos)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+
+	"toolman.org/numbers/stdsize"
+)
+
+// minVolumeSize is the smallest volume ontap creates
+const minVolumeSize = 20 * 1024 * 1024
+
+// storageServices are the ontap application storage services. Each comes with an adaptive QoS policy of the same name.
+var storageServices = map[string]bool{"value": true, "performance": true, "extreme": true}
+
+// planSettings holds the ontap specific settings of a plan. They are read from the ontap block of the plan in catalog.json
+type planSettings struct {
+	Replicated     bool                `json:"replicated"`
+	Encrypted      bool                `json:"encrypted"`
+	Size           planSize            `json:"size"`
+	StorageService string              `json:"storage_service"`
+	Aggregate      string              `json:"aggregate"`
+	Qos            *planQos            `json:"qos"`
+	SnapshotPolicy string              `json:"snapshot_policy"`
+	Share          cifsShareProperties `json:"share"`
+}
+
+// storageService defaults to value, which is what the broker always used before plans could choose
+func (s planSettings) storageService() string {
+	if s.StorageService == "" {
+		return "value"
+	}
+
+	return s.StorageService
+}
+
+// planSize limits the size of volumes of a plan. Sizes are strings like 10Gi. A plan with min and max equal to the default has a fixed size.
+type planSize struct {
+	Default   string `json:"default"`
+	Min       string `json:"min"`
+	Max       string `json:"max"`
+	Increment string `json:"increment"`
+
+	defaultBytes, minBytes, maxBytes, incrementBytes int64
+}
+
+// parse converts the sizes to bytes and returns the problems found. Sizes above maxVolumeSize (MAX_VOLUME_SIZE) could never be provisioned.
+func (s *planSize) parse(maxVolumeSize int64) []string {
+	var problems []string
+
+	for _, f := range []struct {
+		name  string
+		value string
+		bytes *int64
+	}{
+		{"default", s.Default, &s.defaultBytes},
+		{"min", s.Min, &s.minBytes},
+		{"max", s.Max, &s.maxBytes},
+		{"increment", s.Increment, &s.incrementBytes},
+	} {
+		if f.value == "" {
+			continue
+		}
+
+		size, err := stdsize.Parse(f.value)
+		if err != nil || size <= 0 {
+			problems = append(problems, fmt.Sprintf("size %s %q is not a valid size", f.name, f.value))
+			continue
+		}
+		*f.bytes = int64(size)
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	if s.minBytes != 0 && s.minBytes < minVolumeSize {
+		problems = append(problems, fmt.Sprintf("size min %s is smaller than the smallest volume ontap creates (20Mi)", s.Min))
+	}
+
+	if s.minBytes > maxVolumeSize {
+		problems = append(problems, fmt.Sprintf("size min %s is larger than MAX_VOLUME_SIZE %v", s.Min, stdsize.Value(maxVolumeSize)))
+	}
+
+	if s.maxBytes > maxVolumeSize {
+		problems = append(problems, fmt.Sprintf("size max %s is larger than MAX_VOLUME_SIZE %v", s.Max, stdsize.Value(maxVolumeSize)))
+	}
+
+	if s.maxBytes != 0 && s.maxBytes < s.minBytes {
+		problems = append(problems, fmt.Sprintf("size max %s is smaller than min %s", s.Max, s.Min))
+	}
+
+	if s.defaultBytes != 0 {
+		if s.defaultBytes < minVolumeSize || s.defaultBytes < s.minBytes || (s.maxBytes != 0 && s.defaultBytes > s.maxBytes) || s.defaultBytes > maxVolumeSize {
+			problems = append(problems, fmt.Sprintf("size default %s is outside the allowed sizes of the plan", s.Default))
+		}
+
+		if s.incrementBytes != 0 && s.defaultBytes%s.incrementBytes != 0 {
+			problems = append(problems, fmt.Sprintf("size default %s is not a multiple of increment %s", s.Default, s.Increment))
+		}
+	}
+
+	return problems
+}
+
+func (b *broker) planSettings(planID string) planSettings {
+	return b.catalog.plans[planID]
+}
+
+// maxVolumeSize is the maximum of the plan, limited by MAX_VOLUME_SIZE
+func (b *broker) maxVolumeSize(planID string) int64 {
+	max := b.planSettings(planID).Size.maxBytes
+	if max == 0 || max > b.env.MaxVolumeSizeBytes {
+		return b.env.MaxVolumeSizeBytes
+	}
+
+	return max
+}
+
+// volumeSize checks the requested size against the plan and returns it in bytes. Without a requested size the plan default is used.
+func (b *broker) volumeSize(planID, requested string) (int64, error) {
+	limits := b.planSettings(planID).Size
+
+	if requested == "" {
+		if limits.defaultBytes == 0 {
+			return 0, fmt.Errorf("This plan has no default size, please provide one with -c '{\"size\": \"10Gi\"}'")
+		}
+		requested = limits.Default
+	}
+
+	parsed, err := stdsize.Parse(requested)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse size %s. Allowed modifiers: K,M,G,T,P,Ki,Mi,Gi,Ti,Pi", requested)
+	}
+	size := int64(parsed)
+
+	if err = b.checkVolumeSize(planID, size); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// checkVolumeSize returns an error when the plan doesn't allow volumes of this size
+func (b *broker) checkVolumeSize(planID string, size int64) error {
+	limits := b.planSettings(planID).Size
+
+	min := limits.minBytes
+	if min < minVolumeSize {
+		min = minVolumeSize
+	}
+	max := b.maxVolumeSize(planID)
+
+	if min == max && size != min {
+		return fmt.Errorf("This plan has a fixed size of %v, the volume size is %v", stdsize.Value(min), stdsize.Value(size))
+	}
+
+	if size < min {
+		return fmt.Errorf("Volume size %v is smaller than the minimum of %v", stdsize.Value(size), stdsize.Value(min))
+	}
+
+	if size > max {
+		return fmt.Errorf("Volume size %v exceeds the maximum of %v", stdsize.Value(size), stdsize.Value(max))
+	}
+
+	if limits.incrementBytes != 0 && size%limits.incrementBytes != 0 {
+		return fmt.Errorf("Volume size %v is not a multiple of %s", stdsize.Value(size), limits.Increment)
+	}
+
+	return nil
+}
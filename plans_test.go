@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testMaxVolumeSize = 2 << 40
+
+func TestPlanSizeParse(t *testing.T) {
+	for _, tc := range []struct {
+		size     planSize
+		problems []string
+	}{
+		{planSize{}, nil},
+		{planSize{Default: "10Gi", Min: "1Gi", Max: "100Gi", Increment: "1Gi"}, nil},
+		{planSize{Default: "ten"}, []string{`size default "ten" is not a valid size`}},
+		{planSize{Min: "1Mi"}, []string{"size min 1Mi is smaller than the smallest volume ontap creates (20Mi)"}},
+		{planSize{Min: "10Gi", Max: "1Gi"}, []string{"size max 1Gi is smaller than min 10Gi"}},
+		{planSize{Min: "3Ti"}, []string{"size min 3Ti is larger than MAX_VOLUME_SIZE 2Ti"}},
+		{planSize{Max: "4Ti"}, []string{"size max 4Ti is larger than MAX_VOLUME_SIZE 2Ti"}},
+		{planSize{Default: "3Ti"}, []string{"size default 3Ti is outside the allowed sizes of the plan"}},
+		{planSize{Default: "200Gi", Max: "100Gi"}, []string{"size default 200Gi is outside the allowed sizes of the plan"}},
+		{planSize{Default: "15Gi", Increment: "10Gi"}, []string{"size default 15Gi is not a multiple of increment 10Gi"}},
+	} {
+		if problems := tc.size.parse(testMaxVolumeSize); !reflect.DeepEqual(problems, tc.problems) {
+			t.Errorf("%+v: expected %q, got %q", tc.size, tc.problems, problems)
+		}
+	}
+}
+
+func TestVolumeSize(t *testing.T) {
+	plans := map[string]planSettings{
+		"open":      {},
+		"fixed":     {Size: planSize{Default: "10Gi", Min: "10Gi", Max: "10Gi"}},
+		"increment": {Size: planSize{Default: "10Gi", Min: "10Gi", Max: "100Gi", Increment: "10Gi"}},
+	}
+	for id, settings := range plans {
+		if problems := settings.Size.parse(testMaxVolumeSize); problems != nil {
+			t.Fatalf("%s: %v", id, problems)
+		}
+		plans[id] = settings
+	}
+
+	b := &broker{env: brokerConfig{MaxVolumeSizeBytes: testMaxVolumeSize}, catalog: brokerCatalog{plans: plans}}
+
+	for _, tc := range []struct {
+		plan, requested string
+		size            int64
+		err             bool
+	}{
+		{"open", "", 0, true},
+		{"open", "10Gi", 10 << 30, false},
+		{"open", "1Mi", 0, true},
+		{"open", "3Ti", 0, true},
+		{"open", "big", 0, true},
+		{"fixed", "", 10 << 30, false},
+		{"fixed", "20Gi", 0, true},
+		{"increment", "30Gi", 30 << 30, false},
+		{"increment", "35Gi", 0, true},
+		{"increment", "200Gi", 0, true},
+	} {
+		size, err := b.volumeSize(tc.plan, tc.requested)
+		if (err != nil) != tc.err || size != tc.size {
+			t.Errorf("%s %q: expected %d (error %t), got %d (%v)", tc.plan, tc.requested, tc.size, tc.err, size, err)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// planQos attaches a QoS policy to the volumes of a plan. Either an existing (shared) policy group or
+// fixed or adaptive limits, for which every instance gets a policy group of its own.
+type planQos struct {
+	Policy   string       `json:"policy"`
+	Fixed    *QosFixed    `json:"fixed"`
+	Adaptive *QosAdaptive `json:"adaptive"`
+	// Limits bound the max values the qos provision parameter may ask for. Without limits the parameter is rejected.
+	Limits *QosFixed `json:"limits"`
+}
+
+// validate returns the problems of the qos block of a plan
+func (q *planQos) validate() []string {
+	var problems []string
+
+	set := 0
+	for _, s := range []bool{q.Policy != "", q.Fixed != nil, q.Adaptive != nil} {
+		if s {
+			set++
+		}
+	}
+	if set != 1 {
+		problems = append(problems, "qos needs exactly one of policy, fixed and adaptive")
+	}
+
+	if f := q.Fixed; f != nil {
+		if f.MaxThroughputIOPS == 0 && f.MaxThroughputMBPS == 0 && f.MinThroughputIOPS == 0 && f.MinThroughputMBPS == 0 {
+			problems = append(problems, "qos fixed has no limits")
+		}
+		if f.MaxThroughputIOPS != 0 && f.MinThroughputIOPS > f.MaxThroughputIOPS {
+			problems = append(problems, "qos fixed min_throughput_iops is larger than max_throughput_iops")
+		}
+		if f.MaxThroughputMBPS != 0 && f.MinThroughputMBPS > f.MaxThroughputMBPS {
+			problems = append(problems, "qos fixed min_throughput_mbps is larger than max_throughput_mbps")
+		}
+	}
+
+	if a := q.Adaptive; a != nil {
+		if a.ExpectedIOPS <= 0 || a.PeakIOPS <= 0 {
+			problems = append(problems, "qos adaptive needs expected_iops and peak_iops")
+		} else if a.PeakIOPS < a.ExpectedIOPS {
+			problems = append(problems, "qos adaptive peak_iops is smaller than expected_iops")
+		}
+	}
+
+	if l := q.Limits; l != nil {
+		if q.Fixed == nil {
+			problems = append(problems, "qos limits can only be used with fixed qos")
+		} else {
+			if l.MaxThroughputIOPS != 0 && l.MaxThroughputIOPS < q.Fixed.MaxThroughputIOPS {
+				problems = append(problems, "qos limits max_throughput_iops is smaller than the fixed max_throughput_iops")
+			}
+			if l.MaxThroughputMBPS != 0 && l.MaxThroughputMBPS < q.Fixed.MaxThroughputMBPS {
+				problems = append(problems, "qos limits max_throughput_mbps is smaller than the fixed max_throughput_mbps")
+			}
+		}
+	}
+
+	return problems
+}
+
+// qosPolicyName is the name of the policy group of an instance, plans with fixed or adaptive qos create it
+func qosPolicyName(volumeName string) string {
+	return volumeName + "_qos"
+}
+
+// qosPolicy is the QoS policy group the volume should be in. Without qos in the plan that is the adaptive policy of the storage service.
+func (s planSettings) qosPolicy(volumeName string) string {
+	switch {
+	case s.Qos == nil:
+		return s.storageService()
+	case s.Qos.Policy != "":
+		return s.Qos.Policy
+	}
+
+	return qosPolicyName(volumeName)
+}
+
+// desiredQos returns the policy group the instance needs, or nil when the plan uses a shared policy.
+// The override replaces the fixed max values of the plan within its limits. Values equal to the plan's are always allowed.
+func (b *broker) desiredQos(planID, volumeName string, override *QosParameters) (*QosPolicy, error) {
+	q := b.planSettings(planID).Qos
+	if q == nil || (q.Fixed == nil && q.Adaptive == nil) {
+		if override != nil {
+			return nil, fmt.Errorf("This plan doesn't allow to set QoS limits")
+		}
+		return nil, nil
+	}
+
+	policy := &QosPolicy{Name: qosPolicyName(volumeName)}
+	policy.Svm.Name = b.env.OntapSvmName
+	if q.Adaptive != nil {
+		a := *q.Adaptive
+		policy.Adaptive = &a
+	}
+	if q.Fixed != nil {
+		f := *q.Fixed
+		policy.Fixed = &f
+	}
+
+	if override == nil {
+		return policy, nil
+	}
+
+	if q.Fixed == nil {
+		return nil, fmt.Errorf("This plan doesn't allow to set QoS limits")
+	}
+
+	var limits QosFixed
+	if q.Limits != nil {
+		limits = *q.Limits
+	}
+
+	for _, o := range []struct {
+		name           string
+		requested      int64
+		limit, current *int64
+	}{
+		{"max_iops", override.MaxIOPS, &limits.MaxThroughputIOPS, &policy.Fixed.MaxThroughputIOPS},
+		{"max_mbps", override.MaxMBPS, &limits.MaxThroughputMBPS, &policy.Fixed.MaxThroughputMBPS},
+	} {
+		if o.requested == 0 || o.requested == *o.current {
+			continue
+		}
+
+		if *o.limit == 0 {
+			return nil, fmt.Errorf("This plan doesn't allow to set QoS %s", o.name)
+		}
+		if o.requested > *o.limit {
+			return nil, fmt.Errorf("Requested QoS %s %d exceeds the limit of %d of this plan", o.name, o.requested, *o.limit)
+		}
+		*o.current = o.requested
+	}
+
+	if f := policy.Fixed; (f.MaxThroughputIOPS != 0 && f.MinThroughputIOPS > f.MaxThroughputIOPS) || (f.MaxThroughputMBPS != 0 && f.MinThroughputMBPS > f.MaxThroughputMBPS) {
+		return nil, fmt.Errorf("Requested QoS maximum is below the guaranteed minimum of this plan")
+	}
+
+	return policy, nil
+}
+
+// volumeComment is the comment the broker puts on the volume of an instance. It keeps the qos values the user asked for,
+// the policy group can't tell them apart from the defaults of the plan.
+type volumeComment struct {
+	Qos *QosParameters `json:"qos,omitempty"`
+}
+
+func (c volumeComment) encode() string {
+	bytes, _ := json.Marshal(c)
+	return string(bytes)
+}
+
+// qosOverride returns the requested values that differ from the defaults of the plan, nil when there are none
+func (b *broker) qosOverride(planID string, requested *QosParameters) *QosParameters {
+	q := b.planSettings(planID).Qos
+	if requested == nil || q == nil || q.Fixed == nil {
+		return nil
+	}
+
+	override := QosParameters{}
+	if requested.MaxIOPS != q.Fixed.MaxThroughputIOPS {
+		override.MaxIOPS = requested.MaxIOPS
+	}
+	if requested.MaxMBPS != q.Fixed.MaxThroughputMBPS {
+		override.MaxMBPS = requested.MaxMBPS
+	}
+
+	if override == (QosParameters{}) {
+		return nil
+	}
+	return &override
+}
+
+// currentQosOverride returns the qos values the user asked for at provision, so they survive upgrades and plan changes.
+// Volumes without them (created by older broker versions, or with a comment of someone else) get the defaults of the plan.
+func currentQosOverride(vol Volume) *QosParameters {
+	var comment volumeComment
+	if err := json.Unmarshal([]byte(vol.Comment), &comment); err != nil {
+		return nil
+	}
+
+	return comment.Qos
+}
+
+// recordQosOverride keeps the qos values the user asked for in the comment of the volume. Returns true once they are there.
+func (b *broker) recordQosOverride(ctx context.Context, operation, instanceID string, override QosParameters) (bool, error) {
+	if done, ok, err := b.steps.status(ctx, operation, "qos-override"); ok {
+		return done, err
+	}
+
+	name := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	id, err := b.ontapClient.GetVolumeIDByName(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	vol, err := b.ontapClient.GetVolumeByID(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	comment := volumeComment{Qos: &override}.encode()
+	if vol.Comment == comment {
+		return true, nil
+	}
+
+	jobID, err := b.ontapClient.SetVolumeComment(ctx, id, comment)
+	if err == nil {
+		b.steps.track(operation, "qos-override", b.ontapClient, jobID)
+		auditObject(ctx, "volume", name)
+		auditJob(ctx, jobID)
+	}
+	return false, err
+}
+
+// qosMatches reports whether the policy group has the values the plan sets. Values the plan leaves out are not compared,
+// ontap fills in defaults for some of them.
+func qosMatches(current, desired QosPolicy) bool {
+	if (current.Fixed == nil) != (desired.Fixed == nil) || (current.Adaptive == nil) != (desired.Adaptive == nil) {
+		return false
+	}
+
+	var values []struct{ have, want int64 }
+	if f := desired.Fixed; f != nil {
+		values = append(values, []struct{ have, want int64 }{
+			{current.Fixed.MaxThroughputIOPS, f.MaxThroughputIOPS},
+			{current.Fixed.MaxThroughputMBPS, f.MaxThroughputMBPS},
+			{current.Fixed.MinThroughputIOPS, f.MinThroughputIOPS},
+			{current.Fixed.MinThroughputMBPS, f.MinThroughputMBPS},
+		}...)
+	}
+	if a := desired.Adaptive; a != nil {
+		values = append(values, []struct{ have, want int64 }{
+			{current.Adaptive.ExpectedIOPS, a.ExpectedIOPS},
+			{current.Adaptive.PeakIOPS, a.PeakIOPS},
+			{current.Adaptive.AbsoluteMinIOPS, a.AbsoluteMinIOPS},
+		}...)
+	}
+
+	for _, v := range values {
+		if v.want != 0 && v.have != v.want {
+			return false
+		}
+	}
+
+	return true
+}
+
+// syncQosPolicy creates or updates the policy group. Returns the ontap job, or an empty job when the policy group is up to date.
+func (b *broker) syncQosPolicy(ctx context.Context, policy QosPolicy) (string, error) {
+	current, err := b.ontapClient.GetQosPolicy(ctx, policy.Svm.Name, policy.Name)
+	if errors.Is(err, ErrNotFound) {
+		jobID, err := b.ontapClient.CreateQosPolicy(ctx, policy)
+		if err == nil {
+			auditObject(ctx, "qos-policy", policy.Svm.Name+"/"+policy.Name)
+			auditJob(ctx, jobID)
+		}
+		return jobID, err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if qosMatches(current, policy) {
+		return "", nil
+	}
+
+	jobID, err := b.ontapClient.UpdateQosPolicy(ctx, current.UUID, policy.Fixed, policy.Adaptive)
+	if err == nil {
+		auditObject(ctx, "qos-policy", policy.Svm.Name+"/"+policy.Name)
+		auditJob(ctx, jobID)
+	}
+	return jobID, err
+}
+
+// applyQosPolicy returns true once the policy group of the instance matches, an error when the job that changes it failed
+func (b *broker) applyQosPolicy(ctx context.Context, operation string, policy QosPolicy) (bool, error) {
+	if done, ok, err := b.steps.status(ctx, operation, "qos"); ok {
+		return done, err
+	}
+
+	jobID, err := b.syncQosPolicy(ctx, policy)
+	if err != nil || jobID == "" {
+		return err == nil, err
+	}
+
+	b.steps.track(operation, "qos", b.ontapClient, jobID)
+	return false, nil
+}
+
+// removeQosPolicy deletes the policy group of the instance once no volume uses it: after the volume is deleted, or moved to a
+// plan without a policy group of its own. Returns true when there is none (left).
+func (b *broker) removeQosPolicy(ctx context.Context, operation, instanceID string) (bool, error) {
+	if done, ok, err := b.steps.status(ctx, operation, "remove-qos"); ok {
+		return done, err
+	}
+
+	name := qosPolicyName(generateVolumeName(b.env.VolumeNamePrefix, instanceID))
+	policy, err := b.ontapClient.GetQosPolicy(ctx, b.env.OntapSvmName, name)
+	if errors.Is(err, ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	jobID, err := b.ontapClient.DeleteQosPolicy(ctx, policy.UUID)
+	if err == nil {
+		b.steps.track(operation, "remove-qos", b.ontapClient, jobID)
+		auditObject(ctx, "qos-policy", b.env.OntapSvmName+"/"+name)
+		auditJob(ctx, jobID)
+	}
+	return false, err
+}
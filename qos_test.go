@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDesiredQos(t *testing.T) {
+	b := &broker{env: brokerConfig{OntapSvmName: "svm1"}, catalog: brokerCatalog{plans: map[string]planSettings{
+		"none":     {},
+		"shared":   {Qos: &planQos{Policy: "gold"}},
+		"adaptive": {Qos: &planQos{Adaptive: &QosAdaptive{ExpectedIOPS: 1000, PeakIOPS: 2000}}},
+		"fixed":    {Qos: &planQos{Fixed: &QosFixed{MaxThroughputIOPS: 1000, MaxThroughputMBPS: 100}}},
+		"limited": {Qos: &planQos{
+			Fixed:  &QosFixed{MaxThroughputIOPS: 1000, MinThroughputIOPS: 500},
+			Limits: &QosFixed{MaxThroughputIOPS: 5000},
+		}},
+	}}}
+
+	for _, tc := range []struct {
+		plan     string
+		override *QosParameters
+		fixed    *QosFixed
+		err      string
+	}{
+		{"none", nil, nil, ""},
+		{"shared", nil, nil, ""},
+		{"none", &QosParameters{MaxIOPS: 100}, nil, "This plan doesn't allow to set QoS limits"},
+		{"adaptive", &QosParameters{MaxIOPS: 100}, nil, "This plan doesn't allow to set QoS limits"},
+		{"fixed", nil, &QosFixed{MaxThroughputIOPS: 1000, MaxThroughputMBPS: 100}, ""},
+		{"fixed", &QosParameters{MaxIOPS: 1000}, &QosFixed{MaxThroughputIOPS: 1000, MaxThroughputMBPS: 100}, ""},
+		{"fixed", &QosParameters{MaxIOPS: 2000}, nil, "This plan doesn't allow to set QoS max_iops"},
+		{"limited", &QosParameters{MaxIOPS: 5000}, &QosFixed{MaxThroughputIOPS: 5000, MinThroughputIOPS: 500}, ""},
+		{"limited", &QosParameters{MaxIOPS: 5001}, nil, "Requested QoS max_iops 5001 exceeds the limit of 5000 of this plan"},
+		{"limited", &QosParameters{MaxIOPS: 400}, nil, "Requested QoS maximum is below the guaranteed minimum of this plan"},
+		{"limited", &QosParameters{MaxMBPS: 10}, nil, "This plan doesn't allow to set QoS max_mbps"},
+	} {
+		policy, err := b.desiredQos(tc.plan, "A_vol", tc.override)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s %+v: expected %q, got %v", tc.plan, tc.override, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %+v: %v", tc.plan, tc.override, err)
+			continue
+		}
+
+		if tc.fixed != nil && (policy == nil || !reflect.DeepEqual(policy.Fixed, tc.fixed)) {
+			t.Errorf("%s %+v: expected %+v, got %+v", tc.plan, tc.override, tc.fixed, policy)
+		}
+	}
+
+	policy, _ := b.desiredQos("adaptive", "A_vol", nil)
+	if policy == nil || policy.Name != "A_vol_qos" || policy.Svm.Name != "svm1" || policy.Adaptive.PeakIOPS != 2000 {
+		t.Errorf("unexpected adaptive policy %+v", policy)
+	}
+
+	if policy, _ := b.desiredQos("shared", "A_vol", nil); policy != nil {
+		t.Errorf("expected no policy group for a shared policy, got %+v", policy)
+	}
+}
+
+func TestQosMatches(t *testing.T) {
+	desired := QosPolicy{Adaptive: &QosAdaptive{ExpectedIOPS: 1000, PeakIOPS: 2000}}
+
+	for _, tc := range []struct {
+		current QosPolicy
+		matches bool
+	}{
+		//ontap fills in absolute_min_iops
+		{QosPolicy{Adaptive: &QosAdaptive{ExpectedIOPS: 1000, PeakIOPS: 2000, AbsoluteMinIOPS: 500}}, true},
+		{QosPolicy{Adaptive: &QosAdaptive{ExpectedIOPS: 1000, PeakIOPS: 3000}}, false},
+		{QosPolicy{Fixed: &QosFixed{MaxThroughputIOPS: 1000}}, false},
+	} {
+		if got := qosMatches(tc.current, desired); got != tc.matches {
+			t.Errorf("%+v: expected %t, got %t", tc.current.Adaptive, tc.matches, got)
+		}
+	}
+}
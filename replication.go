@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// site is a cluster/svm combination volumes are served from
+type site struct {
+	client       *OntapClient
+	svmName      string
+	cifsHostname string
+}
+
+func (b *broker) primarySite() site {
+	return site{
+		client:       b.ontapClient,
+		svmName:      b.env.OntapSvmName,
+		cifsHostname: b.env.CifsHostname,
+	}
+}
+
+func drVolumeName(volumeName string) string {
+	return volumeName + "_dr"
+}
+
+func (b *broker) snapmirrorPaths(instanceID string) (string, string) {
+	volumeName := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	return fmt.Sprintf("%s:%s", b.env.OntapSvmName, volumeName), fmt.Sprintf("%s:%s", b.dr.svmName, drVolumeName(volumeName))
+}
+
+// replicationRelationship returns nil when replication is not configured or the plan of the instance is not replicated.
+// Instances of other plans never depend on the DR cluster being reachable.
+func (b *broker) replicationRelationship(ctx context.Context, instanceID, planID string) (*SnapmirrorRelationship, error) {
+	if b.dr == nil || !b.planSettings(planID).Replicated {
+		return nil, nil
+	}
+
+	return b.drRelationship(ctx, instanceID)
+}
+
+// drRelationship looks up the snapmirror relationship of the instance on the DR cluster
+func (b *broker) drRelationship(ctx context.Context, instanceID string) (*SnapmirrorRelationship, error) {
+	_, destination := b.snapmirrorPaths(instanceID)
+	return b.dr.client.GetSnapmirrorRelationship(ctx, destination)
+}
+
+// failed snapmirror transfer states
+var failedTransfers = map[string]bool{
+	"failed":       true,
+	"aborted":      true,
+	"hard_aborted": true,
+}
+
+// ensureReplication creates the snapmirror relationship for the instance if it doesn't exist yet. Returns true once the relationship is initialized.
+func (b *broker) ensureReplication(ctx context.Context, operation, instanceID string) (bool, error) {
+	if b.dr == nil {
+		return false, final(fmt.Errorf("No DR destination configured"))
+	}
+
+	//the relationship is created by a job, a failed job fails the operation
+	created, tracked, err := b.steps.status(ctx, operation, "replication")
+	if err != nil || (tracked && !created) {
+		return false, err
+	}
+
+	rel, err := b.drRelationship(ctx, instanceID)
+	if err != nil {
+		return false, err
+	}
+
+	if rel == nil {
+		if created {
+			return false, final(fmt.Errorf("SnapMirror relationship missing after it was created"))
+		}
+
+		source, destination := b.snapmirrorPaths(instanceID)
+		jobID, err := b.dr.client.CreateSnapmirrorRelationship(ctx, source, destination, b.env.DrSnapmirrorPolicy, b.env.DrTransferSchedule)
+		if err == nil {
+			b.steps.track(operation, "replication", b.dr.client, jobID)
+			auditObject(ctx, "snapmirror-relationship", destination)
+			auditJob(ctx, jobID)
+		}
+		return false, err
+	}
+
+	switch {
+	case rel.State == "snapmirrored":
+		return true, nil
+	case rel.State == "broken_off" || rel.State == "paused":
+		return false, final(fmt.Errorf("SnapMirror relationship is %s", rel.State))
+	case rel.Transfer != nil && failedTransfers[rel.Transfer.State]:
+		reasons := []string{"transfer " + rel.Transfer.State}
+		for _, r := range rel.UnhealthyReason {
+			reasons = append(reasons, r.Message)
+		}
+		return false, final(fmt.Errorf("SnapMirror initialization failed: %s", strings.Join(reasons, ", ")))
+	}
+
+	return false, nil
+}
+
+// teardownVolumes deletes the source and destination volume of a replicated instance once the relationship is gone.
+// Returns true when both volumes no longer exist.
+func (b *broker) teardownVolumes(ctx context.Context, operation, instanceID string) (bool, error) {
+	volumeName := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+
+	done := true
+	for _, v := range []struct {
+		client *OntapClient
+		name   string
+	}{
+		{b.ontapClient, volumeName},
+		{b.dr.client, drVolumeName(volumeName)},
+	} {
+		step := "delete/" + v.client.URL.Host + "/" + v.name
+		deleted, tracked, err := b.steps.status(ctx, operation, step)
+		if err != nil {
+			return false, err
+		}
+
+		id, err := v.client.GetVolumeIDByName(ctx, v.name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		done = false
+		//the delete started by a previous poll is still running
+		if tracked && !deleted {
+			continue
+		}
+
+		jobID, err := v.client.DeleteVolume(ctx, id)
+		if err != nil {
+			return false, fmt.Errorf("Deleting volume %s failed: %w", v.name, err)
+		}
+		b.steps.track(operation, step, v.client, jobID)
+		auditObject(ctx, "volume", v.client.URL.Host+"/"+v.name)
+		auditJob(ctx, jobID)
+	}
+
+	return done, nil
+}
+
+// replicationStatus is reported in GetInstance. GetInstance doesn't know the plan, so the DR cluster is asked for every instance.
+func (b *broker) replicationStatus(ctx context.Context, instanceID string) (map[string]interface{}, error) {
+	if b.dr == nil {
+		return nil, nil
+	}
+
+	rel, err := b.drRelationship(ctx, instanceID)
+	if err != nil || rel == nil {
+		return nil, err
+	}
+
+	status := map[string]interface{}{
+		"source":      rel.Source.Path,
+		"destination": rel.Destination.Path,
+		"state":       rel.State,
+		"healthy":     rel.Healthy,
+		"lag_time":    rel.LagTime,
+		"failed_over": rel.State == "broken_off",
+	}
+
+	var reasons []string
+	for _, r := range rel.UnhealthyReason {
+		reasons = append(reasons, r.Message)
+	}
+	if len(reasons) > 0 {
+		status["unhealthy_reason"] = reasons
+	}
+
+	return status, nil
+}
+
+// siteFor returns the site that currently serves the instance. After a failover that is the DR site.
+func (b *broker) siteFor(ctx context.Context, instanceID, planID string) (site, error) {
+	rel, err := b.replicationRelationship(ctx, instanceID, planID)
+	if err != nil {
+		return site{}, err
+	}
+
+	if rel != nil && rel.State == "broken_off" {
+		return *b.dr, nil
+	}
+
+	return b.primarySite(), nil
+}
+
+// bindingSites returns every site a binding of the plan could have its cifs user on
+func (b *broker) bindingSites(planID string) []site {
+	sites := []site{b.primarySite()}
+	if b.dr != nil && b.planSettings(planID).Replicated {
+		sites = append(sites, *b.dr)
+	}
+
+	return sites
+}
+
+// Failover breaks the mirror of the instance and makes the destination volume available as a share on the DR site.
+// New bindings are served from the DR site afterwards. Existing bindings keep pointing at the primary cifs host: the cloud
+// controller keeps the mount config it got at bind time, so apps have to be rebound (unbind, bind, restage) to use the DR site.
+// Their users are deleted on the source svm so apps can't keep writing to a volume that isn't replicated anymore.
+func (b *broker) Failover(ctx context.Context, instanceID string) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	ctx, logger := b.session(ctx, "failover", lager.Data{"instance-id": instanceID})
+	defer logOutcome(logger, &err)
+
+	ctx, rec := b.audit.start(ctx, "failover", auditEvent{InstanceID: instanceID})
+	defer rec.finish(&err)
+
+	rel, err := b.drRelationship(ctx, instanceID)
+	if err != nil {
+		return fmt.Errorf("GetSnapmirrorRelationship failed: %w", err)
+	}
+
+	if rel == nil {
+		return fmt.Errorf("Instance %s is not replicated", instanceID)
+	}
+
+	if rel.State != "broken_off" {
+		jobID, err := b.dr.client.BreakSnapmirrorRelationship(ctx, rel.UUID)
+		if err != nil {
+			return fmt.Errorf("BreakSnapmirrorRelationship failed: %w", err)
+		}
+		logger.Info("snapmirror-break-started", lager.Data{"relationship": rel.UUID, "job-uuid": jobID})
+		auditObject(ctx, "snapmirror-relationship", rel.UUID)
+		auditJob(ctx, jobID)
+
+		if err = b.dr.client.WaitForJob(ctx, jobID); err != nil {
+			return err
+		}
+	}
+
+	volumeName := generateVolumeName(b.env.VolumeNamePrefix, instanceID)
+	id, err := b.dr.client.GetVolumeIDByName(ctx, drVolumeName(volumeName))
+	if err != nil {
+		return fmt.Errorf("error lookup volume with name %s", drVolumeName(volumeName))
+	}
+
+	vol, err := b.dr.client.GetVolumeByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("GetVolumeByID failed: %w", err)
+	}
+
+	if vol.Nas.Path == "" {
+		jobID, err := b.dr.client.MountVolume(ctx, id, "/"+volumeName)
+		if err != nil {
+			return fmt.Errorf("MountVolume failed: %w", err)
+		}
+		auditObject(ctx, "volume", drVolumeName(volumeName))
+		auditJob(ctx, jobID)
+
+		if err = b.dr.client.WaitForJob(ctx, jobID); err != nil {
+			return err
+		}
+	}
+
+	//checked on its own so a failover that stopped after mounting creates the share on the next attempt
+	svmID, err := b.dr.client.SvmUUID(ctx, b.dr.svmName)
+	if err != nil {
+		return fmt.Errorf("SvmUUID failed: %w", err)
+	}
+
+	_, err = b.dr.client.GetCifsShare(ctx, svmID, volumeName)
+	if errors.Is(err, ErrNotFound) {
+		//the share keeps the name of the source share so only the hostname changes for bindings
+		if err = b.dr.client.CreateCifsShare(ctx, b.dr.svmName, volumeName, "/"+volumeName); err != nil {
+			return fmt.Errorf("CreateCifsShare failed: %w", err)
+		}
+		auditObject(ctx, "cifs-share", b.dr.svmName+"/"+volumeName)
+	} else if err != nil {
+		return fmt.Errorf("GetCifsShare failed: %w", err)
+	}
+
+	b.removeSourceUsers(ctx, volumeName)
+
+	return nil
+}
+
+// removeSourceUsers deletes the cifs users of the share on the primary site. The primary is often unreachable during a failover,
+// so failures are only logged. Unbind deletes the users on both sites, so nothing is leaked for long.
+func (b *broker) removeSourceUsers(ctx context.Context, volumeName string) {
+	logger := loggerFromContext(ctx)
+	primary := b.primarySite()
+
+	svmID, err := primary.client.SvmUUID(ctx, primary.svmName)
+	if err != nil {
+		logger.Error("source-users-not-removed", err)
+		return
+	}
+
+	users, err := primary.client.CifsShareUsers(ctx, svmID, volumeName)
+	if err != nil {
+		logger.Error("source-users-not-removed", err)
+		return
+	}
+
+	for _, user := range users {
+		if err = primary.client.DeleteCifsUser(ctx, primary.svmName, user); err != nil {
+			logger.Error("source-user-not-removed", err, lager.Data{"user": user, "svm": primary.svmName})
+			continue
+		}
+		logger.Info("source-user-removed", lager.Data{"user": user, "svm": primary.svmName})
+		auditObject(ctx, "cifs-user", primary.svmName+"/"+user)
+	}
+}
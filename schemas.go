@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/v7/domain"
+	"github.com/pivotal-cf/brokerapi/v7/domain/apiresponses"
+)
+
+const autosizeSchema = `{
+	"type": "object",
+	"description": "Let ontap grow (and shrink) the volume when it fills up",
+	"additionalProperties": false,
+	"required": ["mode"],
+	"properties": {
+		"mode": {"type": "string", "enum": ["grow", "grow_shrink", "off"]},
+		"maximum": {"type": "string", "description": "Maximum size autosize may grow the volume to, e.g. 500Gi. Defaults to the maximum volume size"},
+		"grow_threshold": {"type": "integer", "minimum": 1, "maximum": 99, "description": "Used space percentage at which the volume grows"}
+	}
+}`
+
+const provisionSchema = `{
+	"$schema": "http://json-schema.org/draft-04/schema#",
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"size": {"type": "string", "description": "Volume size, e.g. 10Gi. Allowed modifiers: K,M,G,T,P,Ki,Mi,Gi,Ti,Pi"},
+		"autosize": ` + autosizeSchema + `
+	}
+}`
+
+const qosSchema = `{
+	"type": "object",
+	"description": "QoS limits of the volume, within the limits of the plan",
+	"additionalProperties": false,
+	"properties": {
+		"max_iops": {"type": "integer", "minimum": 1, "description": "Maximum throughput in IOPS"},
+		"max_mbps": {"type": "integer", "minimum": 1, "description": "Maximum throughput in MB/s"}
+	}
+}`
+
+const updateSchema = `{
+	"$schema": "http://json-schema.org/draft-04/schema#",
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"autosize": ` + autosizeSchema + `
+	}
+}`
+
+const bindSchema = `{
+	"$schema": "http://json-schema.org/draft-04/schema#",
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"mount": {"type": "string", "pattern": "^/", "description": "Path the share is mounted on in the container. Defaults to /var/vcap/data/<volume name>"}
+	}
+}`
+
+func mustParseSchema(schema string) map[string]interface{} {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &parsed); err != nil {
+		panic(fmt.Sprintf("invalid built-in schema: %s", err))
+	}
+
+	return parsed
+}
+
+// defaultSchemas are published for plans that don't define their own schemas in catalog.json. Size is required when the plan has no default,
+// qos is only offered by plans with qos limits.
+func defaultSchemas(settings planSettings) *domain.ServiceSchemas {
+	create := mustParseSchema(provisionSchema)
+	if settings.Size.Default == "" {
+		create["required"] = []interface{}{"size"}
+	}
+	if settings.Qos != nil && settings.Qos.Limits != nil {
+		create["properties"].(map[string]interface{})["qos"] = mustParseSchema(qosSchema)
+	}
+
+	return &domain.ServiceSchemas{
+		Instance: domain.ServiceInstanceSchema{
+			Create: domain.Schema{Parameters: create},
+			Update: domain.Schema{Parameters: mustParseSchema(updateSchema)},
+		},
+		Binding: domain.ServiceBindingSchema{
+			Create: domain.Schema{Parameters: mustParseSchema(bindSchema)},
+		},
+	}
+}
+
+type schemaKind int
+
+const (
+	instanceCreate schemaKind = iota
+	instanceUpdate
+	bindingCreate
+)
+
+// validateParameters checks the raw parameters against the schema the plan publishes in the catalog
+func (b *broker) validateParameters(planID string, kind schemaKind, raw json.RawMessage) error {
+	schemas := b.catalog.schemas[planID]
+	if schemas == nil {
+		schemas = defaultSchemas(b.planSettings(planID))
+	}
+
+	var schema map[string]interface{}
+	switch kind {
+	case instanceCreate:
+		schema = schemas.Instance.Create.Parameters
+	case instanceUpdate:
+		schema = schemas.Instance.Update.Parameters
+	case bindingCreate:
+		schema = schemas.Binding.Create.Parameters
+	}
+
+	if schema == nil {
+		return nil
+	}
+
+	if problems := validateJSON(schema, raw); len(problems) > 0 {
+		return apiresponses.NewFailureResponse(fmt.Errorf("Invalid parameters: %s", strings.Join(problems, "; ")), http.StatusBadRequest, "validate-parameters")
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// defaultConfigService is the name or tag of the bound service that holds config values, overridable with CONFIG_SERVICE_NAME
+const defaultConfigService = "ontapsmb-broker-config"
+
+type vcapService struct {
+	Name        string                 `json:"name"`
+	Tags        []string               `json:"tags"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+// configKeys returns the environment variable names of the brokerConfig fields
+func configKeys() []string {
+	t := reflect.TypeOf(brokerConfig{})
+
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("envconfig"); tag != "" {
+			keys = append(keys, strings.ToUpper(tag))
+		}
+	}
+
+	return keys
+}
+
+// resolveSecrets returns values for the config variables that are not set in the environment. A value is taken from the file named by KEY_FILE,
+// or else from the credentials of the config service in VCAP_SERVICES (a user-provided or CredHub service instance).
+// The values are only in the environment while the config is loaded, see processWithSecrets.
+func resolveSecrets() (map[string]string, error) {
+	credentials, err := configServiceCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string)
+	for _, key := range configKeys() {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+
+		value, found, err := secretValue(key, credentials)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			secrets[key] = value
+		}
+	}
+
+	return secrets, nil
+}
+
+func secretValue(key string, credentials map[string]interface{}) (string, bool, error) {
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("Unable to read %s_FILE: %s", key, err)
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+
+	for name, value := range credentials {
+		if strings.EqualFold(name, key) {
+			return credentialString(value)
+		}
+	}
+
+	return "", false, nil
+}
+
+func credentialString(value interface{}) (string, bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return v, true, nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				//a list of objects like BROKER_USERS is passed on as json
+				data, err := json.Marshal(v)
+				return string(data), err == nil, err
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), true, nil
+	case map[string]interface{}:
+		data, err := json.Marshal(v)
+		return string(data), err == nil, err
+	default:
+		return fmt.Sprint(v), true, nil
+	}
+}
+
+// configServiceCredentials returns the credentials of the bound services named or tagged like the config service
+func configServiceCredentials() (map[string]interface{}, error) {
+	vcap := os.Getenv("VCAP_SERVICES")
+	if vcap == "" {
+		return nil, nil
+	}
+
+	var services map[string][]vcapService
+	if err := json.Unmarshal([]byte(vcap), &services); err != nil {
+		return nil, fmt.Errorf("Unable to parse VCAP_SERVICES: %s", err)
+	}
+
+	name := os.Getenv("CONFIG_SERVICE_NAME")
+	if name == "" {
+		name = defaultConfigService
+	}
+
+	credentials := make(map[string]interface{})
+	for _, instances := range services {
+		for _, s := range instances {
+			if s.Name != name && !contains(s.Tags, name) {
+				continue
+			}
+
+			for k, v := range s.Credentials {
+				credentials[k] = v
+			}
+		}
+	}
+
+	return credentials, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reloadCredentials loads the config again and applies changed broker and ontap credentials. Other settings need a restart.
+// Only values from *_FILE files can change this way: the environment, including VCAP_SERVICES, is fixed for the life of the process
+// so changed config service credentials need a restage. Returns the config in effect.
+func reloadCredentials(logger lager.Logger, current brokerConfig, brokerAuth *brokerAuth, b *broker) brokerConfig {
+	config, err := brokerConfigLoad()
+	if err != nil {
+		logger.Error("reload-failed", err)
+		return current
+	}
+
+	var changed []string
+	if !reflect.DeepEqual(config.Users, current.Users) {
+		brokerAuth.set(config.Users)
+		changed = append(changed, "broker-users")
+	}
+
+	if config.OntapUser != current.OntapUser || config.OntapPassword != current.OntapPassword {
+		b.ontapClient.SetCredentials(config.OntapUser, config.OntapPassword)
+		changed = append(changed, "ontap")
+	}
+
+	if b.dr != nil && (config.DrOntapUser != current.DrOntapUser || config.DrOntapPassword != current.DrOntapPassword) {
+		b.dr.client.SetCredentials(config.DrOntapUser, config.DrOntapPassword)
+		changed = append(changed, "dr-ontap")
+	}
+
+	logger.Info("credentials-reloaded", lager.Data{"changed": changed})
+
+	return config
+}
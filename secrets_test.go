@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ONTAP_PASSWORD_FILE", file)
+	t.Setenv("ONTAP_USER", "from-env")
+	t.Setenv("VCAP_SERVICES", `{"user-provided":[{"name":"ontapsmb-broker-config","credentials":{"ontap_user":"from-vcap","ontap_url":"https://cluster1","ontap_retryable_error_codes":["1","2"]}}]}`)
+
+	secrets, err := resolveSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"ONTAP_PASSWORD":              "from-file",
+		"ONTAP_URL":                   "https://cluster1",
+		"ONTAP_RETRYABLE_ERROR_CODES": "1,2",
+	}
+	if !reflect.DeepEqual(secrets, expected) {
+		t.Errorf("expected %v, got %v", expected, secrets)
+	}
+
+	if _, set := os.LookupEnv("ONTAP_PASSWORD"); set {
+		t.Error("secrets must not be put into the environment")
+	}
+}
+
+func TestProcessWithSecrets(t *testing.T) {
+	var spec struct {
+		Name     string        `envconfig:"test_name" required:"true"`
+		Password string        `envconfig:"test_password" required:"true"`
+		Timeout  time.Duration `envconfig:"test_timeout" default:"10s"`
+		Codes    []string      `envconfig:"test_codes" default:"4,5"`
+	}
+
+	t.Setenv("TEST_NAME", "broker")
+	err := processWithSecrets(&spec, map[string]string{"TEST_NAME": "from-file", "TEST_PASSWORD": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.Name != "broker" || spec.Password != "secret" || spec.Timeout != 10*time.Second || !reflect.DeepEqual(spec.Codes, []string{"4", "5"}) {
+		t.Errorf("unexpected config %+v", spec)
+	}
+
+	if _, set := os.LookupEnv("TEST_PASSWORD"); set {
+		t.Error("secrets must not stay in the environment")
+	}
+	if os.Getenv("TEST_NAME") != "broker" {
+		t.Error("the environment must be left alone")
+	}
+
+	if err = processWithSecrets(&spec, nil); err == nil {
+		t.Error("expected an error for a missing required value")
+	}
+}
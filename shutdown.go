@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inflightTracker remembers the requests being handled so the ones cut off by a shutdown can be logged
+type inflightTracker struct {
+	mu   sync.Mutex
+	next uint64
+	ops  map[uint64]string
+}
+
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{ops: make(map[uint64]string)}
+}
+
+func (t *inflightTracker) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		id := t.next
+		t.next++
+		t.ops[id] = fmt.Sprintf("%s %s (started %s)", r.Method, r.URL.Path, time.Now().Format(time.RFC3339))
+		t.mu.Unlock()
+
+		defer func() {
+			t.mu.Lock()
+			delete(t.ops, id)
+			t.mu.Unlock()
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (t *inflightTracker) pending() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ops := make([]string, 0, len(t.ops))
+	for _, op := range t.ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	return ops
+}
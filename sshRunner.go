@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHCommand is a cli command to run on the cluster. Input lines are written to stdin one at a time so the cli has time to prompt for them.
+type SSHCommand struct {
+	Cmd   string
+	Input []string
+}
+
+// SSHResult is the captured outcome of a command
+type SSHResult struct {
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+}
+
+// CommandRunner runs cli commands on the cluster. OntapClient only talks to it through this interface so a fake can be used in tests.
+type CommandRunner interface {
+	// Run returns a *CommandError when the command exits non-zero, the result is filled in either way
+	Run(ctx context.Context, command SSHCommand) (SSHResult, error)
+	// SetCredentials is used for new connections, idle connections are closed
+	SetCredentials(username, password string)
+	Close() error
+}
+
+type OntapSSHOptions struct {
+	Port            int
+	HostKeyCallback ssh.HostKeyCallback
+	DialTimeout     time.Duration
+	Keepalive       time.Duration
+	MaxIdle         int
+	InputDelay      time.Duration
+	CommandTimeout  time.Duration
+}
+
+// sshRunner keeps a pool of ssh connections. Each command gets its own session on a pooled connection.
+type sshRunner struct {
+	address    string
+	config     *ssh.ClientConfig
+	keepalive  time.Duration
+	maxIdle    int
+	inputDelay time.Duration
+
+	mu     sync.Mutex
+	idle   []*ssh.Client
+	closed bool
+}
+
+func newSSHRunner(host, username, password string, options OntapSSHOptions) *sshRunner {
+	if options.Port == 0 {
+		options.Port = 22
+	}
+
+	if options.DialTimeout == 0 {
+		options.DialTimeout = 15 * time.Second
+	}
+
+	if options.InputDelay == 0 {
+		options.InputDelay = 250 * time.Millisecond
+	}
+
+	return &sshRunner{
+		address: net.JoinHostPort(host, strconv.Itoa(options.Port)),
+		config: &ssh.ClientConfig{
+			User: username,
+			Auth: []ssh.AuthMethod{
+				ssh.Password(password),
+			},
+			HostKeyCallback: options.HostKeyCallback,
+			Timeout:         options.DialTimeout,
+		},
+		keepalive:  options.Keepalive,
+		maxIdle:    options.MaxIdle,
+		inputDelay: options.InputDelay,
+	}
+}
+
+func (r *sshRunner) dial() (*ssh.Client, error) {
+	r.mu.Lock()
+	config := r.config
+	r.mu.Unlock()
+
+	client, err := ssh.Dial("tcp", r.address, config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to dial: %s", err)
+	}
+
+	if r.keepalive > 0 {
+		go r.sendKeepalives(client)
+	}
+
+	return client, nil
+}
+
+// sendKeepalives stops when the connection is closed, either by us or because the keepalive failed
+func (r *sshRunner) sendKeepalives(client *ssh.Client) {
+	ticker := time.NewTicker(r.keepalive)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			client.Close()
+			return
+		}
+	}
+}
+
+func (r *sshRunner) get() (*ssh.Client, bool, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		client := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return client, true, nil
+	}
+	r.mu.Unlock()
+
+	client, err := r.dial()
+	return client, false, err
+}
+
+func (r *sshRunner) put(client *ssh.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || len(r.idle) >= r.maxIdle {
+		client.Close()
+		return
+	}
+
+	r.idle = append(r.idle, client)
+}
+
+// session returns a new session, replacing a pooled connection that went stale with a fresh one
+func (r *sshRunner) session() (*ssh.Client, *ssh.Session, error) {
+	client, pooled, err := r.get()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil && pooled {
+		client.Close()
+		if client, err = r.dial(); err != nil {
+			return nil, nil, err
+		}
+		session, err = client.NewSession()
+	}
+
+	if err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("Failed to create session: %s", err)
+	}
+
+	return client, session, nil
+}
+
+func (r *sshRunner) Run(ctx context.Context, command SSHCommand) (SSHResult, error) {
+	client, session, err := r.session()
+	if err != nil {
+		return SSHResult{}, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	var stdin io.WriteCloser
+	if len(command.Input) > 0 {
+		if stdin, err = session.StdinPipe(); err != nil {
+			client.Close()
+			return SSHResult{}, err
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if err := session.Start(command.Cmd); err != nil {
+			done <- err
+			return
+		}
+
+		for _, line := range command.Input {
+			time.Sleep(r.inputDelay)
+			fmt.Fprintf(stdin, "%s\n", line)
+		}
+
+		done <- session.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		//the connection is in an unknown state, don't hand it out again
+		client.Close()
+		<-done
+		return SSHResult{Stdout: stdout.String(), Stderr: stderr.String(), ExitStatus: -1}, fmt.Errorf("Command %q aborted: %s", command.Cmd, ctx.Err())
+	}
+
+	result := SSHResult{Stdout: stdout.String(), Stderr: stderr.String()}
+	switch e := err.(type) {
+	case nil:
+		r.put(client)
+	case *ssh.ExitError:
+		result.ExitStatus = e.ExitStatus()
+		r.put(client)
+		err = &CommandError{Cmd: command.Cmd, Result: result, err: err}
+	default:
+		result.ExitStatus = -1
+		client.Close()
+	}
+
+	return result, err
+}
+
+func (r *sshRunner) SetCredentials(username, password string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config := *r.config
+	config.User = username
+	config.Auth = []ssh.AuthMethod{ssh.Password(password)}
+	r.config = &config
+
+	for _, client := range r.idle {
+		client.Close()
+	}
+	r.idle = nil
+}
+
+func (r *sshRunner) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	for _, client := range r.idle {
+		client.Close()
+	}
+	r.idle = nil
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeRunner records the commands it gets and answers with canned results
+type fakeRunner struct {
+	commands []SSHCommand
+	results  map[string]SSHResult
+	username string
+	password string
+	deadline bool
+}
+
+func (f *fakeRunner) Run(ctx context.Context, command SSHCommand) (SSHResult, error) {
+	f.commands = append(f.commands, command)
+	_, f.deadline = ctx.Deadline()
+
+	res := f.results[command.Cmd]
+	if res.ExitStatus != 0 {
+		return res, &CommandError{Cmd: command.Cmd, Result: res, err: errors.New("Process exited with non-zero status")}
+	}
+
+	return res, nil
+}
+
+func (f *fakeRunner) SetCredentials(username, password string) {
+	f.username, f.password = username, password
+}
+
+func (f *fakeRunner) Close() error {
+	return nil
+}
+
+func newFakeClient(results map[string]SSHResult) (*OntapClient, *fakeRunner) {
+	runner := &fakeRunner{results: results}
+	return &OntapClient{cli: runner, commandTimeout: time.Minute}, runner
+}
+
+func TestCreateCifsUserSSH(t *testing.T) {
+	client, runner := newFakeClient(nil)
+
+	if err := client.CreateCifsUser(context.Background(), "svm1", "user1", "secret", "binding1"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []SSHCommand{{
+		Cmd:   "vserver cifs users-and-groups local-user create -user-name user1 -full-name binding1",
+		Input: []string{"secret", "secret", "exit"},
+	}}
+	if !reflect.DeepEqual(runner.commands, expected) {
+		t.Errorf("expected %+v, got %+v", expected, runner.commands)
+	}
+
+	if !runner.deadline {
+		t.Error("command ran without a timeout")
+	}
+}
+
+func TestGetCifsUserByFullnameSSH(t *testing.T) {
+	cmd := "vserver cifs users-and-groups local-user show -fields user-name -full-name binding1"
+	client, _ := newFakeClient(map[string]SSHResult{
+		cmd: {Stdout: "vserver user-name\n------- ---------\nsvm1    svmUser7\n"},
+	})
+
+	username, err := client.GetCifsUserByFullname(context.Background(), "svm1", "binding1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if username != "svmUser7" {
+		t.Errorf("expected svmUser7, got %q", username)
+	}
+}
+
+func TestDeleteCifsUserSSHFailure(t *testing.T) {
+	cmd := "vserver cifs users-and-groups local-user delete -user-name user1"
+	client, _ := newFakeClient(map[string]SSHResult{
+		cmd: {Stderr: "Error: command failed: not authorized for that command", ExitStatus: 1},
+	})
+
+	err := client.DeleteCifsUser(context.Background(), "svm1", "user1")
+
+	var ce *CommandError
+	if !errors.As(err, &ce) || ce.Cmd != cmd {
+		t.Fatalf("expected a CommandError for %q, got %v", cmd, err)
+	}
+
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected ErrPermissionDenied, got %v", err)
+	}
+}
+
+func TestSetCredentialsUpdatesRunner(t *testing.T) {
+	client, runner := newFakeClient(nil)
+
+	client.SetCredentials("admin", "new-password")
+
+	if runner.username != "admin" || runner.password != "new-password" {
+		t.Errorf("runner got %q/%q", runner.username, runner.password)
+	}
+}
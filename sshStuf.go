@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
-	"log"
 	"net"
+	"strings"
 
+	"code.cloudfoundry.org/lager"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // create human-readable SSH-key strings
@@ -14,21 +17,89 @@ func keyString(k ssh.PublicKey) string {
 	return k.Type() + " " + base64.StdEncoding.EncodeToString(k.Marshal()) // e.g. "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTY...."
 }
 
-func trustedHostKeyCallback(trustedKey string) ssh.HostKeyCallback {
+// parseTrustedKeys splits TRUSTED_SSH_KEY. Multiple keys are separated by newlines or commas, entries starting with SHA256: are fingerprints.
+func parseTrustedKeys(trustedKeys string) []string {
+	var keys []string
+	for _, k := range strings.FieldsFunc(trustedKeys, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
 
-	if trustedKey == "" {
-		return func(_ string, _ net.Addr, k ssh.PublicKey) error {
-			log.Printf("WARNING: SSH-key verification is *NOT* in effect: to fix, add this trustedKey: %q", keyString(k))
-			return nil
+	return keys
+}
+
+// trustedKey is an entry of TRUSTED_SSH_KEY, either a public key or a SHA256 fingerprint
+type trustedKey struct {
+	key         ssh.PublicKey
+	fingerprint string
+}
+
+func (t trustedKey) matches(k ssh.PublicKey) bool {
+	if t.key != nil {
+		return bytes.Equal(t.key.Marshal(), k.Marshal())
+	}
+
+	return t.fingerprint == ssh.FingerprintSHA256(k)
+}
+
+// parseTrustedKey accepts keys in authorized_keys format, so a trailing comment is fine
+func parseTrustedKey(s string) (trustedKey, error) {
+	if strings.HasPrefix(s, "SHA256:") {
+		return trustedKey{fingerprint: s}, nil
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return trustedKey{}, fmt.Errorf("Unable to parse trusted key %q: %s", s, err)
+	}
+
+	return trustedKey{key: key}, nil
+}
+
+// newHostKeyCallback accepts a host key when it matches one of the trusted keys or fingerprints, or an entry for the host in the known_hosts file.
+// Without any of them all keys are accepted with a warning, unless strict is set.
+func newHostKeyCallback(logger lager.Logger, trustedKeys, knownHostsFile string, strict bool) (ssh.HostKeyCallback, error) {
+	var keys []trustedKey
+	for _, k := range parseTrustedKeys(trustedKeys) {
+		key, err := parseTrustedKey(k)
+		if err != nil {
+			return nil, err
 		}
+		keys = append(keys, key)
 	}
 
-	return func(_ string, _ net.Addr, k ssh.PublicKey) error {
-		ks := keyString(k)
-		if trustedKey != ks {
-			return fmt.Errorf("SSH-key verification: expected %q but got %q", trustedKey, ks)
+	var knownHosts ssh.HostKeyCallback
+	if knownHostsFile != "" {
+		var err error
+		knownHosts, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load known hosts: %s", err)
 		}
+	}
 
-		return nil
+	if len(keys) == 0 && knownHosts == nil {
+		if strict {
+			return nil, fmt.Errorf("SSH host key verification is required but no trusted keys or known hosts are configured")
+		}
+
+		return func(hostname string, _ net.Addr, k ssh.PublicKey) error {
+			logger.Info("ssh-host-key-not-verified", lager.Data{"host": hostname, "trusted-key": keyString(k)})
+			return nil
+		}, nil
 	}
+
+	return func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+		for _, trusted := range keys {
+			if trusted.matches(k) {
+				return nil
+			}
+		}
+
+		if knownHosts != nil && knownHosts(hostname, remote, k) == nil {
+			return nil
+		}
+
+		return fmt.Errorf("SSH-key verification: key %q (%s) of %s is not trusted", keyString(k), ssh.FingerprintSHA256(k), hostname)
+	}, nil
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func testHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestHostKeyCallbackTrustedKeys(t *testing.T) {
+	key := testHostKey(t)
+	other := testHostKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	for name, trusted := range map[string]string{
+		"key":              keyString(key),
+		"key with comment": keyString(key) + " admin@cluster1",
+		"fingerprint":      ssh.FingerprintSHA256(key),
+		"one of several":   keyString(other) + "\n" + keyString(key) + " comment",
+	} {
+		t.Run(name, func(t *testing.T) {
+			callback, err := newHostKeyCallback(lager.NewLogger("test"), trusted, "", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = callback("cluster1:22", addr, key); err != nil {
+				t.Errorf("trusted key rejected: %s", err)
+			}
+		})
+	}
+
+	callback, err := newHostKeyCallback(lager.NewLogger("test"), keyString(other), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = callback("cluster1:22", addr, key); err == nil {
+		t.Error("untrusted key accepted")
+	}
+
+	if _, err = newHostKeyCallback(lager.NewLogger("test"), "ssh-ed25519 not-base64", "", true); err == nil {
+		t.Error("invalid trusted key accepted")
+	}
+}
+
+func TestHostKeyCallbackKnownHosts(t *testing.T) {
+	key := testHostKey(t)
+	other := testHostKey(t)
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	lines := knownhosts.Line([]string{"cluster1"}, key) + "\n" +
+		knownhosts.Line([]string{knownhosts.HashHostname("cluster2")}, key) + "\n" +
+		knownhosts.Line([]string{"[cluster3]:2222"}, key) + "\n"
+	if err := os.WriteFile(file, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := newHostKeyCallback(lager.NewLogger("test"), "", file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	for _, tc := range []struct {
+		host string
+		key  ssh.PublicKey
+		ok   bool
+	}{
+		{"cluster1:22", key, true},
+		{"cluster2:22", key, true},
+		{"cluster3:2222", key, true},
+		{"cluster3:22", key, false},
+		{"cluster1:22", other, false},
+		{"cluster4:22", key, false},
+	} {
+		err := callback(tc.host, addr, tc.key)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: expected accepted=%t, got %v", tc.host, tc.ok, err)
+		}
+	}
+}
+
+func TestHostKeyCallbackStrict(t *testing.T) {
+	if _, err := newHostKeyCallback(lager.NewLogger("test"), "", "", true); err == nil {
+		t.Error("strict verification without keys must fail")
+	}
+
+	callback, err := newHostKeyCallback(lager.NewLogger("test"), "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = callback("cluster1:22", nil, testHostKey(t)); err != nil {
+		t.Errorf("non strict verification rejected a key: %s", err)
+	}
+}
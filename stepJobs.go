@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// stepJobs keeps track of the ontap jobs started by the steps LastOperation runs after the job of an operation finished.
+// The operation data can't be changed once the cloud controller has it, so the jobs are remembered in memory, per
+// operation and step. A broker restart (or another broker instance answering the poll) loses them, the step then
+// compares the volume again and restarts its job if needed.
+type stepJobs struct {
+	jobs sync.Map
+}
+
+type stepJob struct {
+	client *OntapClient
+	uuid   string
+	done   bool
+}
+
+func stepJobKey(operation, step string) string {
+	return operation + "/" + step
+}
+
+// track remembers the job a step started for the operation
+func (s *stepJobs) track(operation, step string, client *OntapClient, uuid string) {
+	s.jobs.Store(stepJobKey(operation, step), &stepJob{client: client, uuid: uuid})
+}
+
+// status reports on the job the step started earlier. ok is false when there is none, the step has to check the volume then.
+// Otherwise done is true once the job succeeded and a final error is returned when it failed.
+func (s *stepJobs) status(ctx context.Context, operation, step string) (done, ok bool, err error) {
+	key := stepJobKey(operation, step)
+	value, found := s.jobs.Load(key)
+	if !found {
+		return false, false, nil
+	}
+
+	job := value.(*stepJob)
+	if job.done {
+		return true, true, nil
+	}
+
+	res, err := job.client.GetJobStatus(ctx, job.uuid)
+	if errors.Is(err, ErrNotFound) {
+		//ontap purges finished jobs after a while
+		s.jobs.Delete(key)
+		return false, false, nil
+	}
+	if err != nil {
+		return false, true, err
+	}
+
+	var jobStatus JobStatus
+	if err = json.Unmarshal(res.body, &jobStatus); err != nil {
+		return false, true, fmt.Errorf("Error parsing job status for job %s", job.uuid)
+	}
+
+	switch jobStatus.State {
+	case "success":
+		job.done = true
+		return true, true, nil
+	case "failure":
+		return false, true, final(fmt.Errorf("Job %s failed: %s", job.uuid, jobStatus.Message))
+	}
+
+	return false, true, nil
+}
+
+// finish forgets the jobs of an operation once it reached a final state
+func (s *stepJobs) finish(operation string) {
+	s.jobs.Range(func(key, _ interface{}) bool {
+		if strings.HasPrefix(key.(string), operation+"/") {
+			s.jobs.Delete(key)
+		}
+		return true
+	})
+}